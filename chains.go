@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const providerName = "provider"
+
+const defaultConcurrency = 32
+
+// Config describes the database and the chains the tool works with.
+type Config struct {
+	DBFile string `yaml:"db_file"`
+	// DBBackend is the storage engine: leveldb (default), pebble or sqlite.
+	DBBackend string         `yaml:"db_backend"`
+	Provider  *ChainConfig   `yaml:"provider"`
+	Consumers []*ChainConfig `yaml:"consumers"`
+}
+
+// ChainConfig describes a single provider or consumer chain.
+type ChainConfig struct {
+	Name        string   `yaml:"name"`
+	ChainID     string   `yaml:"chain_id"`
+	Endpoints   []string `yaml:"endpoints"`
+	MinHeight   uint64   `yaml:"min_height"`
+	Concurrency int      `yaml:"concurrency"`
+	// RPS limits the RPC requests per second sent to the chain, 0 means unlimited.
+	RPS float64 `yaml:"rps"`
+	// HeadersOnly stores compact block records instead of full blocks.
+	HeadersOnly bool `yaml:"headers_only"`
+	// ClientID is the consumer's ICS client ID on the provider.
+	ClientID string `yaml:"client_id"`
+	// KeyAssignment is set when validators may use a different consensus
+	// key on the consumer than on the provider.
+	KeyAssignment bool `yaml:"key_assignment"`
+	// ConsumerID is the ID the provider assigned to the consumer chain. Newer
+	// providers require it to query the key assignment.
+	ConsumerID string `yaml:"consumer_id"`
+	// KeyAssignmentFile holds the consumer to provider address pairs, applied
+	// at every height. When empty, they are queried from the provider at the
+	// height of each change.
+	KeyAssignmentFile string `yaml:"key_assignment_file"`
+	// SLABlocks and SLALatency bound how many consumer blocks and how much
+	// time a provider validator set change may take to reach the consumer.
+	SLABlocks  uint64        `yaml:"sla_blocks"`
+	SLALatency time.Duration `yaml:"sla_latency"`
+}
+
+// loadConfig reads the chain configuration from path and applies the
+// environment overrides on top of it. A missing file is only an error when
+// required is set, otherwise the chains come from the environment alone.
+func loadConfig(path string, required bool) (*Config, error) {
+	cfg := &Config{}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config file %s", path)
+		}
+	case os.IsNotExist(err) && !required:
+	default:
+		return nil, errors.Wrapf(err, "failed to read config file %s", path)
+	}
+
+	if dbFile := os.Getenv("DB_FILE"); dbFile != "" {
+		cfg.DBFile = dbFile
+	}
+	if cfg.DBFile == "" {
+		cfg.DBFile = "database.db"
+	}
+
+	if dbBackend := os.Getenv("DB_BACKEND"); dbBackend != "" {
+		cfg.DBBackend = dbBackend
+	}
+
+	if cfg.Provider == nil {
+		cfg.Provider = &ChainConfig{
+			Endpoints: []string{"http://localhost:26657"},
+			MinHeight: 1,
+		}
+	}
+	cfg.Provider.Name = providerName
+
+	for _, chain := range cfg.Chains() {
+		if err := chain.applyEnv(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// Chains returns the provider followed by every consumer.
+func (c *Config) Chains() []*ChainConfig {
+	return append([]*ChainConfig{c.Provider}, c.Consumers...)
+}
+
+// Chain returns the configuration of the named chain. Chains that are not in
+// the config file can still be declared through <NAME>_ADDR and <NAME>_MIN_HEIGHT.
+func (c *Config) Chain(name string) (*ChainConfig, error) {
+	for _, chain := range c.Chains() {
+		if chain.Name == name {
+			return chain, nil
+		}
+	}
+
+	chain := &ChainConfig{Name: name}
+
+	if os.Getenv(chain.envKey("ADDR")) == "" {
+		return nil, errors.Errorf("unknown chain %s: not in the config file and %s is not set", name, chain.envKey("ADDR"))
+	}
+
+	if os.Getenv(chain.envKey("MIN_HEIGHT")) == "" {
+		return nil, errors.Errorf("missing %s environment variable", chain.envKey("MIN_HEIGHT"))
+	}
+
+	if err := chain.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	c.Consumers = append(c.Consumers, chain)
+
+	return chain, nil
+}
+
+func (c *ChainConfig) envKey(suffix string) string {
+	return fmt.Sprintf("%s_%s", strings.ToUpper(c.Name), suffix)
+}
+
+// applyEnv overrides the configuration with <NAME>_ADDR and <NAME>_MIN_HEIGHT
+// and fills in the defaults.
+func (c *ChainConfig) applyEnv() error {
+	if c.Name == "" {
+		return errors.New("chain without a name in config file")
+	}
+
+	if addr := os.Getenv(c.envKey("ADDR")); addr != "" {
+		c.Endpoints = parseAddrs(addr)
+	}
+
+	if minHeightStr := os.Getenv(c.envKey("MIN_HEIGHT")); minHeightStr != "" {
+		minHeight, err := strconv.ParseUint(minHeightStr, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", c.envKey("MIN_HEIGHT"))
+		}
+		c.MinHeight = minHeight
+	}
+
+	if c.MinHeight == 0 {
+		c.MinHeight = 1
+	}
+
+	if c.Concurrency <= 0 {
+		c.Concurrency = defaultConcurrency
+	}
+
+	return nil
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -14,10 +15,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/starclusterteam/go-starbox/log"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
-	"github.com/tendermint/tendermint/types"
-	"golang.org/x/sync/semaphore"
 )
 
 func indexProvider(cmd *cobra.Command, args []string) error {
@@ -27,122 +24,620 @@ func indexProvider(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
-	provider, err := NewRPCClient(providerAddr, "provider", db)
+	provider, err := NewRPCClient(cfg.Provider.Endpoints, cfg.Provider.Name, db)
 	if err != nil {
 		return errors.Wrap(err, "failed to create provider client")
 	}
 
-	latestBlock, err := provider.GetLatestBlockHeight()
+	return indexChain(cmd, db, provider, cfg.Provider)
+}
+
+func indexConsumer(cmd *cobra.Command, args []string) error {
+	db, err := newDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
+	if len(args) != 1 {
+		return errors.New("missing consumer address")
+	}
+
+	chain, err := cfg.Chain(args[0])
+	if err != nil {
+		return err
+	}
+
+	consumer, err := NewRPCClient(chain.Endpoints, chain.Name, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to create consumer client")
+	}
+
+	return indexChain(cmd, db, consumer, chain)
+}
+
+// indexChain fetches every height from the chain's min height up to the latest
+// block that is not yet covered by its stored progress. With --follow it keeps
+// polling the node and indexes new blocks as they are produced.
+func indexChain(cmd *cobra.Command, db *Store, rpc *RPCClient, chain *ChainConfig) error {
+	minHeight := chain.MinHeight
+	follow, _ := cmd.Flags().GetBool("follow")
+	pollInterval, _ := cmd.Flags().GetDuration("poll-interval")
+
+	opts := indexOptions{HeadersOnly: chain.HeadersOnly}
+
+	opts.Workers, _ = cmd.Flags().GetInt("workers")
+	if opts.Workers <= 0 {
+		opts.Workers = chain.Concurrency
+	}
+
+	if cmd.Flags().Changed("headers-only") {
+		opts.HeadersOnly, _ = cmd.Flags().GetBool("headers-only")
+	}
+
+	rps, _ := cmd.Flags().GetFloat64("rps")
+	if rps <= 0 {
+		rps = chain.RPS
+	}
+	rpc.SetRateLimit(rps)
+
+	ctx := cmd.Context()
+
+	latestBlock, err := rpc.GetLatestBlockHeight(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to get latest block height")
 	}
 
-	if latestBlock < providerMinHeight {
+	if latestBlock < minHeight {
 		return errors.New("latest block is less than minimum height")
 	}
 
-	log.Infof("Min height: %d", providerMinHeight)
+	progress, err := db.Progress(rpc.Name())
+	if err != nil {
+		return errors.Wrap(err, "failed to load progress")
+	}
+
+	earliestBlock, err := rpc.GetEarliestBlockHeight(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get earliest block height")
+	}
+
+	log.Infof("Min height: %d", minHeight)
+	log.Infof("Earliest available block: %d", earliestBlock)
 	log.Infof("Latest block: %d", latestBlock)
 
+	progress = progress.WithUnavailable(minHeight, earliestBlock)
+	startHeight := minHeight
+
+	if minHeight < earliestBlock {
+		log.Warningf("Blocks %d-%d are pruned on every %s endpoint, recording them as unavailable", minHeight, earliestBlock-1, rpc.Name())
+		startHeight = earliestBlock
+	}
+
+	progress, err = indexRanges(ctx, db, rpc, opts, progress, progress.Plan(startHeight, latestBlock))
+	if err != nil {
+		return err
+	}
+
+	historyErr := indexValsetHistory(ctx, db, rpc, chain, latestBlock)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if !follow {
+		if failed := countHeights(progress.Plan(startHeight, latestBlock)); failed > 0 {
+			return partialData(errors.Errorf("%d blocks of %s failed to index, run index again to retry them", failed, rpc.Name()))
+		}
+		if historyErr != nil {
+			return partialData(historyErr)
+		}
+
+		fmt.Println("Done !!!")
+		return nil
+	}
+
+	log.Infof("Following new blocks on %s every %s", rpc.Name(), pollInterval)
+
+	indexedTip := latestBlock
+
+	for {
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		latestBlock, err := rpc.GetLatestBlockHeight(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Errorf("failed to get latest block height: %s", err)
+			continue
+		}
+
+		if latestBlock <= indexedTip {
+			continue
+		}
+
+		progress, err = indexRanges(ctx, db, rpc, opts, progress, progress.Plan(indexedTip+1, latestBlock))
+		if err != nil {
+			return err
+		}
+
+		// failures are retried by the next run without --follow
+		indexValsetHistory(ctx, db, rpc, chain, latestBlock)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		indexedTip = latestBlock
+	}
+}
+
+// indexValsetHistory extends the stored validator set history of the chain
+// over the blocks just indexed. Failures are logged and returned, the next
+// run retries.
+func indexValsetHistory(ctx context.Context, db *Store, rpc *RPCClient, chain *ChainConfig, latestBlock uint64) error {
+	records, _, err := updateValsetHistory(ctx, db, rpc, chain, latestBlock)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		log.Errorf("failed to update validator set history of %s: %s", chain.Name, err)
+		return errors.Wrapf(err, "failed to update validator set history of %s", chain.Name)
+	}
+
+	log.Debugf("Validator set history of %s has %d changes", chain.Name, len(records))
+	return nil
+}
+
+type indexOptions struct {
+	// Workers is the number of blocks fetched in parallel.
+	Workers int
+	// HeadersOnly stores compact block records instead of full blocks.
+	HeadersOnly bool
+}
+
+// indexRanges indexes every height in plan with a pool of workers and returns
+// the updated progress, which is also saved to the database. When ctx is
+// cancelled, in-flight blocks are finished and the progress made so far is
+// saved before returning.
+func indexRanges(ctx context.Context, db *Store, rpc *RPCClient, opts indexOptions, progress *ChainProgress, plan []HeightRange) (*ChainProgress, error) {
+	log.Infof("Blocks to index: %d in %d ranges", countHeights(plan), len(plan))
+
+	knownFailures, err := db.Failures(rpc.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load failures")
+	}
+
+	reporter := NewProgressReporter("index "+rpc.Name(), "blocks", countHeights(plan))
+	defer reporter.Stop()
+	rpc.SetReporter(reporter)
+	defer rpc.SetReporter(nil)
+
 	var wg sync.WaitGroup
-	lock := semaphore.NewWeighted(32)
+	var mu sync.Mutex
+	failed := []uint64{}
+	heights := make(chan uint64, opts.Workers)
 
-	for i := providerMinHeight; i <= latestBlock; i++ {
+	for w := 0; w < opts.Workers; w++ {
 		wg.Add(1)
-		go func(height uint64) {
-			lock.Acquire(context.Background(), 1)
-			defer lock.Release(1)
+		go func() {
 			defer wg.Done()
 
-			if err := indexBlock(db, provider, height, false); err != nil {
+			for height := range heights {
+				err := indexBlock(ctx, db, rpc, height, false, opts.HeadersOnly)
+				if err == nil {
+					reporter.Add(1)
+					if _, ok := knownFailures[height]; ok {
+						if err := db.DeleteFailure(rpc.Name(), height); err != nil {
+							log.Errorf("failed to clear failure of block %d: %s", height, err)
+						}
+					}
+					continue
+				}
+
+				if ctx.Err() != nil {
+					mu.Lock()
+					failed = append(failed, height)
+					mu.Unlock()
+					continue
+				}
+
+				reporter.Error()
 				log.Errorf("failed to index block %d: %s", height, err)
+				if err := db.PutFailure(rpc.Name(), height, err); err != nil {
+					log.Errorf("failed to record failure of block %d: %s", height, err)
+				}
+
+				mu.Lock()
+				failed = append(failed, height)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// fed holds the part of the plan handed to the workers before ctx was cancelled
+	fed := []HeightRange{}
+
+feed:
+	for _, r := range plan {
+		for i := r.From; i <= r.To; i++ {
+			select {
+			case heights <- i:
+			case <-ctx.Done():
+				if i > r.From {
+					fed = append(fed, HeightRange{From: r.From, To: i - 1})
+				}
+				break feed
 			}
-		}(i)
+		}
+		fed = append(fed, r)
 	}
+	close(heights)
 
 	wg.Wait()
 
-	fmt.Println("Done !!!")
+	progress = progress.Record(fed, failed)
+	if err := db.PutProgress(rpc.Name(), progress); err != nil {
+		return nil, errors.Wrap(err, "failed to save progress")
+	}
+
+	if ctx.Err() != nil {
+		log.Infof("Interrupted, saved progress of %s up to %d", rpc.Name(), progress.Watermark)
+		return progress, ctx.Err()
+	}
+
+	if len(failed) > 0 {
+		log.Errorf("Failed to index %d blocks", len(failed))
+	}
+
+	return progress, nil
+}
+
+func indexStatus(cmd *cobra.Command, args []string) error {
+	db, err := newReadOnlyDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
+	if len(args) != 1 {
+		return errors.New("missing chain name")
+	}
+
+	chain := args[0]
+
+	progress, err := db.Progress(chain)
+	if err != nil {
+		return errors.Wrap(err, "failed to load progress")
+	}
+
+	if progress == nil {
+		fmt.Printf("Chain %s has no recorded progress\n", chain)
+		return nil
+	}
+
+	fmt.Printf("Chain:      %s\n", chain)
+	fmt.Printf("Min height: %d\n", progress.MinHeight)
+	fmt.Printf("Watermark:  %d\n", progress.Watermark)
+	fmt.Printf("Indexed:    %d blocks\n", countHeights(progress.Covered()))
+	fmt.Printf("Missing:    %d blocks in %d ranges\n", progress.MissingCount(), len(progress.Missing))
+
+	for _, r := range progress.Missing {
+		fmt.Printf("  %s\n", r)
+	}
+
+	fmt.Printf("Unavailable from endpoints: %d blocks in %d ranges\n", countHeights(progress.Unavailable), len(progress.Unavailable))
+	for _, r := range progress.Unavailable {
+		fmt.Printf("  %s\n", r)
+	}
+
+	failures, err := db.Failures(chain)
+	if err != nil {
+		return errors.Wrap(err, "failed to load failures")
+	}
+
+	heights := make([]uint64, 0, len(failures))
+	for height := range failures {
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	fmt.Printf("Failed:     %d blocks\n", len(failures))
+	for _, height := range heights {
+		failure := failures[height]
+		fmt.Printf("  %d (%s, retryable: %t): %s\n", height, failure.Time.Format(time.RFC3339), failure.Retryable, failure.Error)
+	}
 
 	return nil
 }
 
-func indexConsumer(cmd *cobra.Command, args []string) error {
+func indexVSC(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing chain name")
+	}
+
+	chain, err := cfg.Chain(args[0])
+	if err != nil {
+		return err
+	}
+
 	db, err := newDB()
 	if err != nil {
 		return errors.Wrap(err, "failed to open database")
 	}
 	defer db.Close()
 
+	rpc, err := NewRPCClient(chain.Endpoints, chain.Name, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to create RPC client")
+	}
+
+	rps, _ := cmd.Flags().GetFloat64("rps")
+	if rps <= 0 {
+		rps = chain.RPS
+	}
+	rpc.SetRateLimit(rps)
+
+	workers, _ := cmd.Flags().GetInt("workers")
+	if workers <= 0 {
+		workers = chain.Concurrency
+	}
+
+	scan, _ := cmd.Flags().GetBool("scan")
+
+	from, _ := cmd.Flags().GetUint64("from")
+	if from == 0 {
+		from = chain.MinHeight
+	}
+
+	to, _ := cmd.Flags().GetUint64("to")
+	if to == 0 {
+		to, err = rpc.GetLatestBlockHeight(cmd.Context())
+		if err != nil {
+			return err
+		}
+	}
+
+	if to < from {
+		return errors.Errorf("last height %d is below first height %d", to, from)
+	}
+
+	return indexVSCEvents(cmd.Context(), db, rpc, from, to, workers, scan)
+}
+
+func valsetHistory(cmd *cobra.Command, args []string) error {
 	if len(args) != 1 {
-		return errors.New("missing consumer address")
+		return errors.New("missing chain name")
+	}
+
+	chain, err := cfg.Chain(args[0])
+	if err != nil {
+		return err
 	}
 
-	consumerName := args[0]
+	from, _ := cmd.Flags().GetUint64("from")
+	to, _ := cmd.Flags().GetUint64("to")
+	sinceStr, _ := cmd.Flags().GetString("since")
+	untilStr, _ := cmd.Flags().GetString("until")
 
-	consumerEnvKey := fmt.Sprintf("%s_ADDR", strings.ToUpper(consumerName))
-	consumerAddr := os.Getenv(consumerEnvKey)
-	if consumerAddr == "" {
-		return errors.Errorf("missing %s environment variable", consumerEnvKey)
+	var since, until time.Time
+	if sinceStr != "" {
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			return errors.Wrap(err, "failed to parse --since")
+		}
+	}
+	if untilStr != "" {
+		if until, err = time.Parse(time.RFC3339, untilStr); err != nil {
+			return errors.Wrap(err, "failed to parse --until")
+		}
+	}
+	if to == 0 {
+		to = math.MaxUint64
 	}
 
-	consumerMinHeightKey := fmt.Sprintf("%s_MIN_HEIGHT", strings.ToUpper(consumerName))
-	consumerMinHeightStr := os.Getenv(consumerMinHeightKey)
-	if consumerMinHeightStr == "" {
-		return errors.Errorf("missing %s environment variable", consumerMinHeightKey)
+	db, err := newReadOnlyDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
 	}
-	consumerMinHeight, err := strconv.ParseUint(consumerMinHeightStr, 10, 64)
+	defer db.Close()
+
+	cursor, err := db.ValsetCursor(chain.Name)
 	if err != nil {
-		return errors.Wrap(err, "failed to parse minimum height")
+		return err
+	}
+	if cursor == nil {
+		return errors.Errorf("no validator set history stored for %s, run index first", chain.Name)
 	}
+	log.Infof("Validator set history of %s covers blocks %d-%d", chain.Name, cursor.Start(), cursor.Height)
 
-	consumer, err := NewRPCClient(consumerAddr, consumerName, db)
+	records, err := db.ValsetHistoryBetween(chain.Name, since, until)
 	if err != nil {
-		return errors.Wrap(err, "failed to create consumer client")
+		return err
 	}
 
-	latestBlock, err := consumer.GetLatestBlockHeight()
+	for _, r := range records {
+		if uint64(r.Height) < from || uint64(r.Height) > to {
+			continue
+		}
+		fmt.Printf("%d,%s,%s,%s,%s,%s\n", r.Height, r.Timestamp.Format(time.RFC3339Nano), r.ValidatorsHash, r.OldValidatorsHash, r.SetHash, r.OldSetHash)
+	}
+
+	return nil
+}
+
+func dbMigrate(cmd *cobra.Command, args []string) error {
+	db, err := openStore(cfg.DBBackend, cfg.DBFile, false)
 	if err != nil {
-		return errors.Wrap(err, "failed to get latest block height")
+		return errors.Wrap(err, "failed to open database")
 	}
+	defer db.Close()
 
-	if latestBlock < consumerMinHeight {
-		return errors.New("latest block is less than minimum height")
+	return migrateSchema(db)
+}
+
+func dbCompact(cmd *cobra.Command, args []string) error {
+	db, err := newDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
 	}
+	defer db.Close()
 
-	log.Infof("Min height: %d", consumerMinHeight)
-	log.Infof("Latest block: %d", latestBlock)
+	headersOnly, _ := cmd.Flags().GetBool("headers-only")
+	if headersOnly {
+		converted, err := convertToHeaders(db)
+		if err != nil {
+			return errors.Wrap(err, "failed to convert blocks")
+		}
+		log.Infof("Converted %d full blocks to headers", converted)
+	}
 
-	var wg sync.WaitGroup
-	lock := semaphore.NewWeighted(32)
+	log.Infof("Compacting database")
+	if err := db.Compact(); err != nil {
+		return errors.Wrap(err, "failed to compact database")
+	}
 
-	for i := consumerMinHeight; i <= latestBlock; i++ {
-		wg.Add(1)
-		go func(height uint64) {
-			lock.Acquire(context.Background(), 1)
-			defer lock.Release(1)
-			defer wg.Done()
+	return nil
+}
 
-			if err := indexBlock(db, consumer, height, false); err != nil {
-				log.Errorf("failed to index block %d: %s", height, err)
-			}
-		}(i)
+func dbExport(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing export file")
 	}
 
-	wg.Wait()
+	opts := ExportOptions{}
+	opts.Chains, _ = cmd.Flags().GetStringSlice("chain")
+	opts.From, _ = cmd.Flags().GetUint64("from")
+	opts.To, _ = cmd.Flags().GetUint64("to")
+
+	if len(opts.Chains) == 0 {
+		for _, chain := range cfg.Chains() {
+			opts.Chains = append(opts.Chains, chain.Name)
+		}
+	}
+
+	if opts.To != 0 && opts.To < opts.From {
+		return errors.New("--to is below --from")
+	}
+
+	db, err := newReadOnlyDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
+	records, err := exportDB(cmd.Context(), db, args[0], opts)
+	if err != nil {
+		return errors.Wrap(err, "failed to export database")
+	}
 
-	fmt.Println("Done !!!")
+	log.Infof("Exported %d records to %s", records, args[0])
 
 	return nil
 }
 
-func getBlock(cmd *cobra.Command, args []string) error {
+func dbImport(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing export file")
+	}
+
 	db, err := newDB()
 	if err != nil {
 		return errors.Wrap(err, "failed to open database")
 	}
 	defer db.Close()
 
+	records, err := importDB(cmd.Context(), db, args[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to import database")
+	}
+
+	log.Infof("Imported %d records from %s", records, args[0])
+
+	return nil
+}
+
+func dbVerify(cmd *cobra.Command, args []string) error {
+	quarantine, _ := cmd.Flags().GetBool("quarantine")
+	refetch, _ := cmd.Flags().GetBool("refetch")
+
+	chains := []*ChainConfig{}
+	for _, name := range args {
+		chain, err := cfg.Chain(name)
+		if err != nil {
+			return err
+		}
+		chains = append(chains, chain)
+	}
+	if len(chains) == 0 {
+		chains = cfg.Chains()
+	}
+
+	var db *Store
+	var err error
+	if quarantine || refetch {
+		db, err = newDB()
+	} else {
+		db, err = newReadOnlyDB()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
+	remaining := 0
+
+	for _, chain := range chains {
+		progress, err := db.Progress(chain.Name)
+		if err != nil {
+			return errors.Wrap(err, "failed to load progress")
+		}
+
+		reporter := NewProgressReporter("verify "+chain.Name, "blocks", countHeights(progress.Covered()))
+		result, err := verifyChain(cmd.Context(), db, chain.Name, reporter)
+		reporter.Stop()
+		if err != nil {
+			return errors.Wrapf(err, "failed to verify %s", chain.Name)
+		}
+
+		fmt.Printf("Chain %s: %d blocks, %d validator sets (%d without public keys), %d issues\n",
+			chain.Name, result.Blocks, result.ValidatorSets, result.Unverifiable, len(result.Issues))
+		for _, issue := range result.Issues {
+			fmt.Printf("  %s\n", issue)
+		}
+
+		if len(result.Issues) == 0 {
+			continue
+		}
+
+		if !quarantine && !refetch {
+			remaining += len(result.Issues)
+			continue
+		}
+
+		left, err := repairIssues(cmd.Context(), db, chain, result.Issues, refetch, quarantine)
+		if err != nil {
+			return errors.Wrapf(err, "failed to repair %s", chain.Name)
+		}
+		remaining += left
+	}
+
+	if remaining > 0 {
+		return &ExitError{Code: exitFindings, Err: errors.Errorf("%d issues are not repaired", remaining)}
+	}
+
+	return nil
+}
+
+func getBlock(cmd *cobra.Command, args []string) error {
+	db, err := newReadOnlyDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
 	if len(args) != 2 {
 		return errors.New("missing consumer address")
 	}
@@ -153,10 +648,7 @@ func getBlock(cmd *cobra.Command, args []string) error {
 		return errors.Wrap(err, "failed to parse block height")
 	}
 
-	key := BlockKey(provider, height)
-
-	data, err := db.Get(key, nil)
-
+	data, err := db.Block(provider, height)
 	if err != nil {
 		return errors.Wrap(err, "failed to get block")
 	}
@@ -168,17 +660,11 @@ func getBlock(cmd *cobra.Command, args []string) error {
 
 	fmt.Println(block)
 
-	key = EvidenceKey(provider, height)
-	ok, err := db.Has(key, nil)
-	if err != nil {
-		return errors.Wrap(err, "failed to check evidence")
+	data, err = db.Evidence(provider, height)
+	if err != nil && err != ErrNotFound {
+		return errors.Wrap(err, "failed to get evidence")
 	}
-	if ok {
-		data, err := db.Get(key, nil)
-		if err != nil {
-			return errors.Wrap(err, "failed to get evidence")
-		}
-
+	if err == nil {
 		fmt.Println(string(data))
 	}
 
@@ -186,7 +672,7 @@ func getBlock(cmd *cobra.Command, args []string) error {
 }
 
 func evidence(cmd *cobra.Command, args []string) error {
-	db, err := newDB()
+	db, err := newReadOnlyDB()
 	if err != nil {
 		return errors.Wrap(err, "failed to open database")
 	}
@@ -198,7 +684,7 @@ func evidence(cmd *cobra.Command, args []string) error {
 
 	provider := args[0]
 
-	iter := db.NewIterator(util.BytesPrefix([]byte(provider+":evidence:")), nil)
+	iter := db.AllEvidence(provider)
 	defer iter.Release()
 
 	// consumerName := args[0]
@@ -233,7 +719,7 @@ func evidence(cmd *cobra.Command, args []string) error {
 }
 
 func validatorSet(cmd *cobra.Command, args []string) error {
-	db, err := newDB()
+	db, err := newReadOnlyDB()
 	if err != nil {
 		return errors.Wrap(err, "failed to open database")
 	}
@@ -249,15 +735,12 @@ func validatorSet(cmd *cobra.Command, args []string) error {
 		return errors.Wrap(err, "failed to parse block height")
 	}
 
-	key := BlockKey(provider, height)
-
-	data, err := db.Get(key, nil)
-
+	data, err := db.Block(provider, height)
 	if err != nil {
 		return errors.Wrap(err, "failed to get block")
 	}
 
-	block, err := BlockFromJSON(data)
+	block, err := BlockRecordFromJSON(data)
 	if err != nil {
 		return errors.Wrap(err, "failed to decode block")
 	}
@@ -287,10 +770,6 @@ func validatorSet(cmd *cobra.Command, args []string) error {
 }
 
 func viewMissingValidator(cmd *cobra.Command, args []string) error {
-	if len(args) != 1 {
-		return errors.New("missing consumer chain name")
-	}
-
 	lb, _ := cmd.Flags().GetUint64("toBlock")
 	var latestBlock *uint64
 	if lb == 0 {
@@ -299,100 +778,463 @@ func viewMissingValidator(cmd *cobra.Command, args []string) error {
 		latestBlock = &lb
 	}
 
-	consumerName := args[0]
+	consumers := cfg.Consumers
+	if len(args) > 0 {
+		consumers = []*ChainConfig{}
+		for _, name := range args {
+			chain, err := cfg.Chain(name)
+			if err != nil {
+				return err
+			}
+			consumers = append(consumers, chain)
+		}
+	}
+	if len(consumers) == 0 {
+		return errors.New("no consumer chains configured")
+	}
 
-	var validatorSetProvider []ValsetUpdate
-	var validatorSetConsumer []ValsetUpdate
-	var err error
+	format, err := outputFormat(cmd)
+	if err != nil {
+		return err
+	}
 
-	db, err := newDB()
+	failOn, err := failOnThresholds(cmd)
+	if err != nil {
+		return err
+	}
+
+	keyAssignmentFile, _ := cmd.Flags().GetString("key-assignment-file")
+	if keyAssignmentFile != "" && len(consumers) != 1 {
+		return errors.New("--key-assignment-file needs exactly one consumer")
+	}
+
+	db, err := newReadOnlyDB()
 	if err != nil {
 		return errors.Wrap(err, "failed to open database")
 	}
 	defer db.Close()
 
-	var wg sync.WaitGroup
+	keys := make([]*KeyAssignmentHistory, len(consumers))
+	for i, consumer := range consumers {
+		keys[i], err = consumerKeyAssignment(db, consumer, keyAssignmentFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var validatorSetProvider []ValsetUpdate
+	var mismatchesProvider []ValsetMismatch
+	var partialProvider bool
+	var providerErr error
+
+	validatorSetConsumers := make([][]ValsetUpdate, len(consumers))
+	mismatchesConsumers := make([][]ValsetMismatch, len(consumers))
+	partialConsumers := make([]bool, len(consumers))
+	consumerErrs := make([]error, len(consumers))
 
-	wg.Add(2)
+	var wg sync.WaitGroup
 
-	go func(db *leveldb.DB) {
+	wg.Add(1)
+	go func() {
 		defer wg.Done()
-		validatorSetProvider, err = validatorSetAll(db, "provider", latestBlock)
-		if err != nil {
-			log.Errorf("failed to get validator set from provider: %s", err)
+		validatorSetProvider, mismatchesProvider, partialProvider, providerErr = validatorSetAll(cmd.Context(), db, providerName, latestBlock)
+		if providerErr != nil {
+			log.Errorf("failed to get validator set from provider: %s", providerErr)
 		}
-	}(db)
+	}()
 
-	go func(db *leveldb.DB) {
-		defer wg.Done()
-		validatorSetConsumer, err = validatorSetAll(db, consumerName, latestBlock)
+	for i, consumer := range consumers {
+		wg.Add(1)
+		go func(i int, consumer *ChainConfig) {
+			defer wg.Done()
+			validatorSetConsumers[i], mismatchesConsumers[i], partialConsumers[i], consumerErrs[i] = validatorSetAll(cmd.Context(), db, consumer.Name, latestBlock)
+			if consumerErrs[i] != nil {
+				log.Errorf("failed to get validator set from %s: %s", consumer.Name, consumerErrs[i])
+			}
+		}(i, consumer)
+	}
+
+	wg.Wait()
+
+	if providerErr != nil {
+		return errors.Wrap(providerErr, "failed to get validator set from provider")
+	}
+	for i, err := range consumerErrs {
 		if err != nil {
-			log.Errorf("failed to get validator set from consumer: %s", err)
+			return errors.Wrapf(err, "failed to get validator set from %s", consumers[i].Name)
 		}
-	}(db)
+	}
 
-	wg.Wait()
+	if len(validatorSetProvider) == 0 {
+		return errors.New("no validator set found on provider")
+	}
 
-	log.Infof("Found %d validator hashes in consumer %s", len(validatorSetConsumer), consumerName)
 	log.Infof("Found %d validator hashes in provider", len(validatorSetProvider))
 
-	firstProviderHash := validatorSetProvider[0]
+	for i, consumer := range consumers {
+		validatorSetConsumers[i], err = keys[i].Translate(cmd.Context(), validatorSetConsumers[i], validatorSetProvider)
+		if err != nil {
+			return errors.Wrapf(err, "failed to translate the consumer keys of %s", consumer.Name)
+		}
+	}
+
+	findings := []Finding{}
+	for _, mismatch := range mismatchesProvider {
+		findings = append(findings, mismatchFinding(mismatch))
+	}
 
-	valset := map[string]ValsetUpdate{}
+	comparisons := []*ConsumerComparison{}
+	hashMismatches := len(mismatchesProvider)
 
-	for _, vs := range validatorSetProvider {
-		valset[vs.Md5Hash] = vs
+	for i, consumer := range consumers {
+		c, err := compareConsumer(db, consumer.Name, validatorSetProvider, validatorSetConsumers[i], mismatchesConsumers[i])
+		if err != nil {
+			return err
+		}
+		comparisons = append(comparisons, c)
+		findings = append(findings, c.Findings...)
+		hashMismatches += c.HashMismatches
 	}
 
-	missingCount := 0
-	notExistedOnProvider := 0
-	outOfOrderCount := 0
+	log.Infof("Found %d validator sets whose hash does not match the header", hashMismatches)
 
-	for _, vs := range validatorSetConsumer {
-		if vs.Timestamp.Before(firstProviderHash.Timestamp) {
-			// skip validator set updates before provider started
-			continue
+	summary := summarizeComparisons(validatorSetProvider, comparisons)
+
+	err = writeReport(os.Stdout, format, findings, summary, func(w io.Writer) {
+		fmt.Fprintln(w)
+		printComparisonMatrix(w, summary)
+		fmt.Fprintln(w)
+		printDeliverySummary(w, summary.Delivery)
+	})
+	if err != nil {
+		return err
+	}
+
+	partial := []string{}
+	if partialProvider {
+		partial = append(partial, providerName)
+	}
+	for i, consumer := range consumers {
+		if partialConsumers[i] {
+			partial = append(partial, consumer.Name)
 		}
+	}
 
-		_, ok := valset[vs.Md5Hash]
-		if !ok {
-			missingCount++
-			log.Infof("[missing] Found consumer validator hash %s at block %d, missing from provider", vs.ValidatorsHash, vs.Height)
-			continue
+	return checkFindings(findings, failOn, partialChains(partial))
+}
+
+// partialChains returns the error of an analysis whose chains are not
+// indexed up to the requested block, or nil if there are none.
+func partialChains(chains []string) error {
+	if len(chains) == 0 {
+		return nil
+	}
+	return partialData(errors.Errorf("%s not indexed up to the requested block, results are incomplete", strings.Join(chains, ", ")))
+}
+
+// consumerKeyAssignment returns the key assignment of a consumer, or nil if
+// it has none configured. file overrides the chain's key_assignment_file.
+func consumerKeyAssignment(db *Store, consumer *ChainConfig, file string) (*KeyAssignmentHistory, error) {
+	if file == "" {
+		file = consumer.KeyAssignmentFile
+	}
+
+	if !consumer.KeyAssignment && file == "" {
+		return nil, nil
+	}
+
+	keys, err := loadKeyAssignment(db, consumer, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load key assignment")
+	}
+
+	return keys, nil
+}
+
+func vscLatency(cmd *cobra.Command, args []string) error {
+	lb, _ := cmd.Flags().GetUint64("toBlock")
+	var latestBlock *uint64
+	if lb != 0 {
+		latestBlock = &lb
+	}
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		return err
+	}
+
+	failOn, err := failOnThresholds(cmd)
+	if err != nil {
+		return err
+	}
+
+	consumers := cfg.Consumers
+	if len(args) > 0 {
+		consumers = []*ChainConfig{}
+		for _, name := range args {
+			chain, err := cfg.Chain(name)
+			if err != nil {
+				return err
+			}
+			consumers = append(consumers, chain)
 		}
+	}
+	if len(consumers) == 0 {
+		return errors.New("no consumer chains configured")
+	}
 
-		// check if validator set update exists on provider before timestamp
-		if !existsBeforeTimestamp(validatorSetProvider, vs.Md5Hash, vs.Timestamp) {
-			notExistedOnProvider++
-			log.Infof("[not existed] Found consumer validator hash %s at block %d, not existed on provider at that time", vs.ValidatorsHash, vs.Height)
-			continue
+	db, err := newReadOnlyDB()
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
+	validatorSetProvider, _, partialProvider, err := validatorSetAll(cmd.Context(), db, providerName, latestBlock)
+	if err != nil {
+		return errors.Wrap(err, "failed to get validator set from provider")
+	}
+
+	summaries := []*LatencySummary{}
+	findings := []Finding{}
+	partial := []string{}
+	if partialProvider {
+		partial = append(partial, providerName)
+	}
+
+	for _, consumer := range consumers {
+		sla := LatencySLA{Blocks: consumer.SLABlocks, Duration: consumer.SLALatency}
+		if cmd.Flags().Changed("sla-blocks") {
+			sla.Blocks, _ = cmd.Flags().GetUint64("sla-blocks")
+		}
+		if cmd.Flags().Changed("sla-latency") {
+			sla.Duration, _ = cmd.Flags().GetDuration("sla-latency")
+		}
+
+		summary, found, err := consumerLatency(cmd.Context(), db, consumer, validatorSetProvider, latestBlock, sla)
+		if err != nil {
+			return errors.Wrapf(err, "failed to measure latency of %s", consumer.Name)
+		}
+		summaries = append(summaries, summary)
+		findings = append(findings, found...)
+		if summary.Partial {
+			partial = append(partial, consumer.Name)
 		}
+	}
 
-		if !isInOrder(validatorSetProvider, vs) {
-			outOfOrderCount++
-			log.Infof("[out of order] Found consumer validator hash %s, old validator hash %s at block %d", vs.ValidatorsHash, vs.OldValidatorsHash, vs.Height)
+	err = writeReport(os.Stdout, format, findings, summaries, func(w io.Writer) {
+		for _, summary := range summaries {
+			fmt.Fprintln(w)
+			printLatencySummary(w, summary)
 		}
+	})
+	if err != nil {
+		return err
+	}
 
-		// // lastpvs, ok := valset[vs.OldValidatorsHash]
-		// // if !ok {
-		// // 	log.Infof("[old valhash missing on provider] Found consumer validator hash %s at block %d, old validator hash %s missing from provider", vs.ValidatorsHash, vs.Height, vs.OldValidatorsHash)
-		// // 	continue
-		// // }
+	return checkFindings(findings, failOn, partialChains(partial))
+}
 
-		// // if lastpvs.Height > pvs.Height {
-		// 	continue
-		// }
+// consumerLatency measures the VSC latency of a consumer. Outliers and
+// changes over sla are returned as findings.
+func consumerLatency(ctx context.Context, db *Store, consumer *ChainConfig, validatorSetProvider []ValsetUpdate, latestBlock *uint64, sla LatencySLA) (*LatencySummary, []Finding, error) {
+	summary := &LatencySummary{Consumer: consumer.Name, Pending: []PendingChange{}}
+
+	keys, err := consumerKeyAssignment(db, consumer, "")
+	if err != nil {
+		return nil, nil, err
 	}
 
-	log.Infof("Found %d missing validator hashes", missingCount)
-	log.Infof("Found %d not existed on provider chain at that time", notExistedOnProvider)
-	log.Infof("Found %d out of order validator hashes", outOfOrderCount)
+	validatorSetConsumer, _, partial, err := validatorSetAll(ctx, db, consumer.Name, latestBlock)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get validator set from consumer")
+	}
 
-	return nil
+	validatorSetConsumer, err = keys.Translate(ctx, validatorSetConsumer, validatorSetProvider)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to translate the consumer keys")
+	}
+	summary.Partial = partial
+
+	progress, err := db.Progress(consumer.Name)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load progress")
+	}
+	// the first indexed range is above the min height when the blocks
+	// before it are pruned or failed to index
+	covered := progress.Covered()
+	if len(covered) == 0 {
+		log.Warningf("No blocks of %s indexed", consumer.Name)
+		summary.Partial = true
+		return summary, nil, nil
+	}
+
+	blocks := &consumerBlocks{db: db, chain: consumer.Name, from: covered[0].From, to: covered[0].To}
+	if blocks.from < consumer.MinHeight {
+		blocks.from = consumer.MinHeight
+	}
+	if latestBlock != nil && *latestBlock < blocks.to {
+		blocks.to = *latestBlock
+	}
+	if blocks.to < blocks.from {
+		log.Warningf("No blocks of %s indexed between %d and %d", consumer.Name, consumer.MinHeight, blocks.to)
+		summary.Partial = true
+		return summary, nil, nil
+	}
+
+	latencies, err := measureLatency(validatorSetProvider, validatorSetConsumer, blocks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	applied := []VSCLatency{}
+	for _, l := range latencies {
+		switch {
+		case l.Superseded:
+			summary.Superseded++
+		case l.Pending():
+			summary.Pending = append(summary.Pending, PendingChange{
+				ProviderHeight: l.Provider.Height,
+				ProviderTime:   l.Provider.Timestamp,
+				Blocks:         l.Blocks,
+				Duration:       l.Duration.Seconds(),
+			})
+		default:
+			applied = append(applied, l)
+		}
+	}
+	summary.Changes = len(latencies)
+	summary.Applied = len(applied)
+
+	findings := []Finding{}
+
+	if len(applied) > 0 {
+		blockValues := make([]float64, 0, len(applied))
+		durationValues := make([]float64, 0, len(applied))
+		for _, l := range applied {
+			blockValues = append(blockValues, float64(l.Blocks))
+			durationValues = append(durationValues, l.Duration.Seconds())
+		}
+
+		blockDist := NewDistribution(blockValues)
+		durationDist := NewDistribution(durationValues)
+		summary.Blocks = newLatencyStats(blockDist, latencyBlockBuckets)
+		summary.Duration = newLatencyStats(durationDist, latencyDurationBuckets)
+
+		for _, l := range applied {
+			if float64(l.Blocks) > summary.Blocks.OutlierFence || l.Duration.Seconds() > summary.Duration.OutlierFence {
+				findings = append(findings, latencyFinding(findingLatencyOutlier, consumer.Name, l,
+					fmt.Sprintf("applied after %d blocks, %s, over %g blocks or %s", l.Blocks, l.Duration, summary.Blocks.OutlierFence, seconds(summary.Duration.OutlierFence))))
+			}
+		}
+	}
+
+	if sla.Set() {
+		summary.SLA = &LatencySLASummary{Blocks: sla.Blocks, Duration: sla.Duration.Seconds()}
+		for _, l := range latencies {
+			if !sla.Exceeded(l) {
+				continue
+			}
+			summary.SLA.Exceeded++
+
+			detail := fmt.Sprintf("applied after %d blocks, %s, over the SLA of %s", l.Blocks, l.Duration, sla)
+			if l.Pending() {
+				detail = fmt.Sprintf("not applied after %d blocks, %s, over the SLA of %s", l.Blocks, l.Duration, sla)
+			}
+			findings = append(findings, latencyFinding(findingLatencySLA, consumer.Name, l, detail))
+		}
+	}
+
+	return summary, findings, nil
+}
+
+func latencyFinding(kind string, chain string, l VSCLatency, detail string) Finding {
+	f := Finding{
+		Type:           kind,
+		Chain:          chain,
+		ProviderHeight: l.Provider.Height,
+		ProviderTime:   timePtr(l.Provider.Timestamp),
+		Hash:           l.Provider.ValidatorsHash,
+		Blocks:         l.Blocks,
+		Duration:       l.Duration.Seconds(),
+		Detail:         detail,
+	}
+	if l.Consumer != nil {
+		f.Height = l.Consumer.Height
+		f.Time = timePtr(l.Consumer.Timestamp)
+	}
+	return f
+}
+
+func seconds(s float64) string {
+	return (time.Duration(s * float64(time.Second))).Round(time.Second).String()
+}
+
+// printLatencySummary prints the latency report of a consumer.
+func printLatencySummary(w io.Writer, summary *LatencySummary) {
+	fmt.Fprintf(w, "Consumer %s: %d provider changes, %d applied, %d superseded, %d pending\n",
+		summary.Consumer, summary.Changes, summary.Applied, summary.Superseded, len(summary.Pending))
+
+	if summary.Blocks != nil {
+		b, d := summary.Blocks, summary.Duration
+		fmt.Fprintf(w, "  Blocks:   p50 %g, p90 %g, p99 %g, max %g\n", b.P50, b.P90, b.P99, b.Max)
+		fmt.Fprintf(w, "  Duration: p50 %s, p90 %s, p99 %s, max %s\n", seconds(d.P50), seconds(d.P90), seconds(d.P99), seconds(d.Max))
+
+		fmt.Fprintf(w, "  Blocks histogram:\n")
+		printHistogram(w, b.Histogram, func(v float64) string { return fmt.Sprintf("%g", v) })
+		fmt.Fprintf(w, "  Duration histogram:\n")
+		printHistogram(w, d.Histogram, seconds)
+	}
+
+	for _, p := range summary.Pending {
+		fmt.Fprintf(w, "  Pending: provider block %d at %s, not applied after %d blocks, %s\n",
+			p.ProviderHeight, p.ProviderTime.Format(time.RFC3339), p.Blocks, seconds(p.Duration))
+	}
+
+	if summary.SLA != nil {
+		sla := LatencySLA{Blocks: summary.SLA.Blocks, Duration: time.Duration(summary.SLA.Duration * float64(time.Second))}
+		fmt.Fprintf(w, "  SLA (%s): %d changes exceed it\n", sla, summary.SLA.Exceeded)
+	}
+}
+
+func printHistogram(w io.Writer, buckets []HistogramBucket, format func(float64) string) {
+	widest := 0
+	for _, b := range buckets {
+		if b.Count > widest {
+			widest = b.Count
+		}
+	}
+
+	for i, b := range buckets {
+		var label string
+		switch {
+		case b.UpTo != 0:
+			label = "<= " + format(b.UpTo)
+		case i > 0:
+			label = "> " + format(buckets[i-1].UpTo)
+		}
+
+		bar := 0
+		if widest > 0 {
+			bar = b.Count * 40 / widest
+		}
+		fmt.Fprintf(w, "    %-8s %6d %s\n", label, b.Count, strings.Repeat("#", bar))
+	}
+}
+
+// activeAt returns the validator set update in effect at timestamp, or nil
+// if the first update is later.
+func activeAt(validatorSet []ValsetUpdate, timestamp time.Time) *ValsetUpdate {
+	i := sort.Search(len(validatorSet), func(i int) bool {
+		return validatorSet[i].Timestamp.After(timestamp)
+	})
+	if i == 0 {
+		return nil
+	}
+	return &validatorSet[i-1]
 }
 
 func isInOrder(validatorSet []ValsetUpdate, vs ValsetUpdate) bool {
-	if vs.OldMd5Hash == "" {
+	if vs.OldSetHash == "" {
 		return true
 	}
 
@@ -405,11 +1247,11 @@ func isInOrder(validatorSet []ValsetUpdate, vs ValsetUpdate) bool {
 			break
 		}
 
-		if foundBlockCurrent == 0 && validatorSet[i].Md5Hash == vs.Md5Hash {
+		if foundBlockCurrent == 0 && validatorSet[i].SetHash == vs.SetHash {
 			foundBlockCurrent = i
 		}
 
-		if foundBlockPrevious == 0 && validatorSet[i].Md5Hash == vs.OldMd5Hash {
+		if foundBlockPrevious == 0 && validatorSet[i].SetHash == vs.OldSetHash {
 			foundBlockPrevious = i
 		}
 
@@ -421,7 +1263,7 @@ func isInOrder(validatorSet []ValsetUpdate, vs ValsetUpdate) bool {
 
 func existsBeforeTimestamp(validatorSet []ValsetUpdate, hash string, timestamp time.Time) bool {
 	for _, vs := range validatorSet {
-		if vs.Md5Hash == hash && vs.Timestamp.Before(timestamp) {
+		if vs.SetHash == hash && vs.Timestamp.Before(timestamp) {
 			return true
 		}
 	}
@@ -429,118 +1271,60 @@ func existsBeforeTimestamp(validatorSet []ValsetUpdate, hash string, timestamp t
 	return false
 }
 
-func validatorSetAll(db *leveldb.DB, chain string, latestBlock *uint64) ([]ValsetUpdate, error) {
-
-	consumerEnvKey := fmt.Sprintf("%s_ADDR", strings.ToUpper(chain))
-	consumerAddr := os.Getenv(consumerEnvKey)
-	if consumerAddr == "" {
-		return nil, errors.Errorf("missing %s environment variable", consumerEnvKey)
-	}
+// validatorSetAll returns every validator set change of a chain up to
+// latestBlock, or the latest block of the chain if nil. The changes come
+// from the stored history, extended with the blocks indexed since. partial is set when a
+// block up to latestBlock, or the indexed tip if nil, is not indexed.
+func validatorSetAll(ctx context.Context, db *Store, chain string, latestBlock *uint64) (validatorSet []ValsetUpdate, mismatches []ValsetMismatch, partial bool, err error) {
 
-	consumerMinHeightKey := fmt.Sprintf("%s_MIN_HEIGHT", strings.ToUpper(chain))
-	consumerMinHeightStr := os.Getenv(consumerMinHeightKey)
-	if consumerMinHeightStr == "" {
-		return nil, errors.Errorf("missing %s environment variable", consumerMinHeightKey)
-	}
-	consumerMinHeight, err := strconv.ParseUint(consumerMinHeightStr, 10, 64)
+	chainConfig, err := cfg.Chain(chain)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse minimum height")
+		return nil, nil, false, err
 	}
 
-	consumer, err := NewRPCClient(consumerAddr, chain, db)
+	consumer, err := NewRPCClient(chainConfig.Endpoints, chain, db)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create RPC client")
+		return nil, nil, false, errors.Wrap(err, "failed to create RPC client")
 	}
 
 	var lb uint64
 
 	if latestBlock == nil {
-		lb, err = consumer.GetLatestBlockHeight()
+		lb, err = consumer.GetLatestBlockHeight(ctx)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to get latest block height")
+			return nil, nil, false, errors.Wrap(err, "failed to get latest block height")
 		}
 	} else {
 		lb = *latestBlock
 	}
 
-	if lb < consumerMinHeight {
-		return nil, errors.New("latest block is less than minimum height")
+	if lb < chainConfig.MinHeight {
+		return nil, nil, false, errors.New("latest block is less than minimum height")
 	}
 
-	validatorSet := []ValsetUpdate{}
-	lastValidatorHash := ""
-	lastMd5Hash := ""
-
-	fileName := fmt.Sprintf("validatorset-%s.csv", chain)
-	file, err := os.Create(fileName)
+	records, reached, err := updateValsetHistory(ctx, db, consumer, chainConfig, lb)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create file")
+		return nil, nil, false, err
 	}
-	defer file.Close()
 
-	for i := consumerMinHeight; i <= lb; i++ {
-		if i%10000 == 0 {
-			log.Infof("Processing block %d on chain %s", i, chain)
-		}
-
-		key := BlockKey(chain, i)
-		exists, err := db.Has(key, nil)
+	// without latestBlock the history only needs to reach the indexed blocks
+	want := lb
+	if latestBlock == nil {
+		progress, err := db.Progress(chain)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to check if block exists")
+			return nil, nil, false, errors.Wrap(err, "failed to load progress")
 		}
-		if !exists {
-			break
+		if progress != nil && progress.Watermark < want {
+			want = progress.Watermark
 		}
+	}
 
-		data, err := db.Get(key, nil)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to get block")
-		}
-
-		block, err := BlockFromJSON(data)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse block: %s", key)
-		}
-
-		validatorsHash := block.ValidatorsHash.String()
-
-		if validatorsHash != lastValidatorHash {
-			log.Debugf("Found new validator set: %s at height %d", validatorsHash, block.Height)
-
-			valsetlist, err := consumer.GetValidatorsAtHeight(block.Height)
-			if err != nil {
-				return nil, errors.Wrapf(err, "failed to get validator set at height %d", block.Height)
-			}
-			md5hash := getValsetHash(valsetlist)
-
-			bh := ValsetUpdate{
-				Height:            block.Height,
-				Timestamp:         block.Time,
-				ValidatorsHash:    validatorsHash,
-				OldValidatorsHash: lastValidatorHash,
-				Md5Hash:           md5hash,
-				OldMd5Hash:        lastMd5Hash,
-			}
-
-			fmt.Fprintf(file, "%d,%s,%s,%s,%s,%s\n", bh.Height, bh.Timestamp, bh.ValidatorsHash, bh.OldValidatorsHash, bh.Md5Hash, bh.OldMd5Hash)
-
-			validatorSet = append(validatorSet, bh)
-
-			lastValidatorHash = validatorsHash
-			lastMd5Hash = md5hash
-		}
+	if reached < want {
+		log.Warningf("Validator set history of %s stops at block %d, blocks up to %d are not all indexed", chain, reached, want)
+		partial = true
 	}
 
-	return validatorSet, nil
-}
+	validatorSet, mismatches = valsetHistoryUpdates(records)
 
-func getValsetHash(valsetlist []*types.Validator) string {
-	valset := []string{}
-	for _, val := range valsetlist {
-		str := fmt.Sprintf("%s:%d", val.Address, val.VotingPower)
-		valset = append(valset, str)
-	}
-	sort.Strings(valset)
-	valsetstr := strings.Join(valset, ";")
-	return fmt.Sprintf("%x", md5.Sum([]byte(valsetstr)))
+	return validatorSet, mismatches, partial, nil
 }
@@ -3,49 +3,168 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	nethttp "net/http"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/starclusterteam/go-starbox/log"
-	"github.com/syndtr/goleveldb/leveldb"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
 	"github.com/tendermint/tendermint/rpc/client/http"
+	"github.com/tendermint/tendermint/rpc/coretypes"
+	jsonrpcclient "github.com/tendermint/tendermint/rpc/jsonrpc/client"
+	rpctypes "github.com/tendermint/tendermint/rpc/jsonrpc/types"
 	"github.com/tendermint/tendermint/types"
+	"golang.org/x/time/rate"
 )
 
+// validatorsPerPage is the largest page size Tendermint allows for /validators.
+const validatorsPerPage = 100
+
+// searchPerPage is the largest page size Tendermint allows for /block_search and /tx_search.
+const searchPerPage = 100
+
+// rpcMethodNotFound is the JSON-RPC error code for unknown methods.
+const rpcMethodNotFound = -32601
+
 type RPCClient struct {
-	addr   string
-	name   string
-	client *http.HTTP
-	db     *leveldb.DB
+	name    string
+	pool    *endpointPool
+	db      *Store
+	retry   RetryConfig
+	limiter *rate.Limiter
+
+	reporter *ProgressReporter
+
+	// noHeaderRPC is set once the endpoints turn out not to serve /header
+	noHeaderRPC uint32
 }
 
-func NewRPCClient(addr string, name string, db *leveldb.DB) (*RPCClient, error) {
-	cl, err := http.New(addr)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create tendermint client")
+// NewRPCClient creates a client that spreads requests over the given RPC
+// endpoints of a chain.
+func NewRPCClient(addrs []string, name string, db *Store) (*RPCClient, error) {
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no RPC endpoints for %s", name)
+	}
+
+	pool := &endpointPool{cfg: rpcEndpoints}
+
+	for _, addr := range addrs {
+		httpClient, err := jsonrpcclient.DefaultHTTPClient(addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create http client for %s", addr)
+		}
+
+		transport := httpClient.Transport
+		if transport == nil {
+			transport = nethttp.DefaultTransport
+		}
+		httpClient.Transport = &statusCheckTransport{next: transport}
+
+		cl, err := http.NewWithClient(addr, httpClient)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create tendermint client for %s", addr)
+		}
+
+		pool.endpoints = append(pool.endpoints, &endpoint{addr: addr, client: cl})
+	}
+
+	return &RPCClient{name: name, pool: pool, db: db, retry: rpcRetry, limiter: rate.NewLimiter(rate.Inf, 1)}, nil
+}
+
+// SetRateLimit caps the requests per second sent to the chain's endpoints.
+// A limit of 0 or less removes the cap.
+func (c *RPCClient) SetRateLimit(rps float64) {
+	if rps <= 0 {
+		c.limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	burst := int(rps)
+	if burst < 1 {
+		burst = 1
 	}
 
-	return &RPCClient{addr: addr, name: name, client: cl, db: db}, nil
+	c.limiter.SetLimit(rate.Limit(rps))
+	c.limiter.SetBurst(burst)
+}
+
+// SetReporter makes the client report the latency of its calls to r.
+func (c *RPCClient) SetReporter(r *ProgressReporter) {
+	c.reporter = r
+}
+
+// do runs fn against an endpoint that can serve height (0 for any), retrying
+// on another endpoint when the call fails.
+func (c *RPCClient) do(ctx context.Context, name string, height int64, fn func(ctx context.Context, client *http.HTTP) error) error {
+	c.pool.refresh(ctx, c.retry.Timeout, false)
+
+	tried := map[*endpoint]bool{}
+
+	return c.retry.retry(ctx, name, func(attemptCtx context.Context) error {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return errors.Wrap(err, "rate limiter")
+		}
+
+		e := c.pool.pick(height, tried)
+		tried[e] = true
+
+		start := time.Now()
+		err := fn(attemptCtx, e.client)
+		c.reporter.ObserveLatency(time.Since(start))
+		if err != nil && isRetryable(err) && !isHeightNotAvailable(err) {
+			log.Debugf("taking endpoint %s out of rotation: %s", e.addr, err)
+			e.markDown(c.pool.cfg.Cooldown)
+		}
+
+		return errors.Wrapf(err, "endpoint %s", e.addr)
+	})
 }
 
 func (c *RPCClient) Name() string {
 	return c.name
 }
 
-func (c *RPCClient) GetLatestBlockHeight() (uint64, error) {
-	response, err := c.client.Status(context.Background())
+func (c *RPCClient) GetLatestBlockHeight(ctx context.Context) (uint64, error) {
+	var latest int64
+	err := c.retry.retry(ctx, "status", func(ctx context.Context) (err error) {
+		c.pool.refresh(ctx, c.retry.Timeout, true)
+		latest, err = c.pool.latest()
+		return err
+	})
 
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to get latest block height")
 	}
 
-	return uint64(response.SyncInfo.LatestBlockHeight), nil
+	return uint64(latest), nil
 }
 
-func (c *RPCClient) GetBlockByHeight(height uint64) (*types.Block, []byte, error) {
+// GetEarliestBlockHeight returns the lowest height any endpoint of the chain
+// still retains.
+func (c *RPCClient) GetEarliestBlockHeight(ctx context.Context) (uint64, error) {
+	var earliest int64
+	err := c.retry.retry(ctx, "status", func(ctx context.Context) (err error) {
+		c.pool.refresh(ctx, c.retry.Timeout, true)
+		earliest, err = c.pool.earliest()
+		return err
+	})
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get earliest block height")
+	}
+
+	return uint64(earliest), nil
+}
+
+func (c *RPCClient) GetBlockByHeight(ctx context.Context, height uint64) (*types.Block, []byte, error) {
 	h := int64(height)
-	response, err := c.client.Block(context.Background(), &h)
+	var response *coretypes.ResultBlock
+	err := c.do(ctx, "block", h, func(ctx context.Context, client *http.HTTP) (err error) {
+		response, err = client.Block(ctx, &h)
+		return err
+	})
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to get block")
 	}
@@ -66,36 +185,240 @@ func (c *RPCClient) GetBlockByHeight(height uint64) (*types.Block, []byte, error
 	return block, evidenceBytes, nil
 }
 
-func (c *RPCClient) GetValidatorsAtHeight(height int64) ([]*types.Validator, error) {
-	key := fmt.Sprintf("%s:validatorz:%d", c.name, height)
-	data, err := c.db.Get([]byte(key), nil)
+// GetBlockRecord fetches the compact record of a block through /header and
+// /commit. Blocks with evidence, or whose previous commit is not available,
+// are fetched in full instead. Evidence is returned like in GetBlockByHeight.
+func (c *RPCClient) GetBlockRecord(ctx context.Context, height uint64) (*BlockRecord, []byte, error) {
+	h := int64(height)
+
+	header, err := c.getHeader(ctx, h)
 	if err != nil {
-		page := 1
-		perPage := 300
-		response, err := c.client.Validators(context.Background(), &height, &page, &perPage)
+		return nil, nil, errors.Wrap(err, "failed to get header")
+	}
+
+	if headerHasEvidence(header) {
+		return c.getBlockRecordFromBlock(ctx, height)
+	}
+
+	record := &BlockRecord{Header: *header, LastCommit: &types.Commit{}}
+
+	if header.LastBlockID.IsZero() {
+		return record, nil, nil
+	}
+
+	lastHeight := h - 1
+	var response *coretypes.ResultCommit
+	err = c.do(ctx, "commit", lastHeight, func(ctx context.Context, client *http.HTTP) (err error) {
+		response, err = client.Commit(ctx, &lastHeight)
+		return err
+	})
+	if err != nil {
+		log.Debugf("failed to get commit %d, fetching block %d: %s", lastHeight, height, err)
+		return c.getBlockRecordFromBlock(ctx, height)
+	}
+
+	record.LastCommit = response.Commit
+
+	return record, nil, nil
+}
+
+func (c *RPCClient) getBlockRecordFromBlock(ctx context.Context, height uint64) (*BlockRecord, []byte, error) {
+	block, evidence, err := c.GetBlockByHeight(ctx, height)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewBlockRecord(block), evidence, nil
+}
+
+// getHeader uses /header, or /commit on nodes that don't have it.
+func (c *RPCClient) getHeader(ctx context.Context, height int64) (*types.Header, error) {
+	if atomic.LoadUint32(&c.noHeaderRPC) == 0 {
+		var response *coretypes.ResultHeader
+		err := c.do(ctx, "header", height, func(ctx context.Context, client *http.HTTP) (err error) {
+			response, err = client.Header(ctx, &height)
+			return err
+		})
+		if err == nil {
+			return response.Header, nil
+		}
+
+		var rpcErr *rpctypes.RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != rpcMethodNotFound {
+			return nil, err
+		}
+
+		log.Infof("%s endpoints have no /header, using /commit", c.name)
+		atomic.StoreUint32(&c.noHeaderRPC, 1)
+	}
+
+	var response *coretypes.ResultCommit
+	err := c.do(ctx, "commit", height, func(ctx context.Context, client *http.HTTP) (err error) {
+		response, err = client.Commit(ctx, &height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Header, nil
+}
+
+// GetValidatorsAtHeight returns the validator set at height, cached with the
+// public keys. Sets cached without public keys are fetched again, unless the
+// database is read-only.
+func (c *RPCClient) GetValidatorsAtHeight(ctx context.Context, height int64) ([]*types.Validator, error) {
+	data, err := c.db.Validators(c.name, uint64(height))
+	if err == nil {
+		validators, err := ValidatorsFromJSON(data)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get validators for block %d", height)
+			return nil, errors.Wrapf(err, "failed to unmarshal validators for block %d", height)
 		}
 
-		for _, v := range response.Validators {
-			v.PubKey = nil
+		if hasPubKeys(validators) || c.db.ReadOnly() {
+			return validators, nil
 		}
+	}
 
-		data, _ = json.Marshal(response.Validators)
+	validators, err := c.fetchValidatorsAtHeight(ctx, height)
+	if err != nil {
+		return nil, err
+	}
 
-		err = c.db.Put([]byte(key), data, nil)
+	if !c.db.ReadOnly() {
+		data, err := ValidatorsToJSON(validators)
+		if err == nil {
+			err = c.db.PutValidators(c.name, uint64(height), data)
+		}
 		if err != nil {
 			log.Errorf("failed to save validators for block %d to db: %s", height, err)
 		}
 	}
 
-	var validators []*types.Validator
-	err = json.Unmarshal(data, &validators)
+	return validators, nil
+}
+
+// fetchValidatorsAtHeight walks every page of the validator set and fails
+// if the result does not add up to the total reported by the node.
+func (c *RPCClient) fetchValidatorsAtHeight(ctx context.Context, height int64) ([]*types.Validator, error) {
+	validators := []*types.Validator{}
+	page := 1
+	perPage := validatorsPerPage
+
+	for {
+		var response *coretypes.ResultValidators
+		err := c.do(ctx, "validators", height, func(ctx context.Context, client *http.HTTP) (err error) {
+			response, err = client.Validators(ctx, &height, &page, &perPage)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get validators for block %d, page %d", height, page)
+		}
+
+		if response.Count != len(response.Validators) {
+			return nil, errors.Errorf("validators for block %d, page %d: got %d validators, response count is %d", height, page, len(response.Validators), response.Count)
+		}
+
+		validators = append(validators, response.Validators...)
+
+		if len(validators) >= response.Total || len(response.Validators) == 0 {
+			if len(validators) != response.Total {
+				return nil, errors.Errorf("validators for block %d: got %d validators, response total is %d", height, len(validators), response.Total)
+			}
+			return validators, nil
+		}
+
+		page++
+	}
+}
+
+// ABCIQuery runs an ABCI query against the state at height, or the latest
+// state if height is 0, and returns the response value.
+func (c *RPCClient) ABCIQuery(ctx context.Context, path string, data []byte, height int64) ([]byte, error) {
+	var response *coretypes.ResultABCIQuery
+	err := c.do(ctx, "abci_query", height, func(ctx context.Context, client *http.HTTP) (err error) {
+		response, err = client.ABCIQueryWithOptions(ctx, path, data, rpcclient.ABCIQueryOptions{Height: height})
+		return err
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal validators for block %d", height)
+		return nil, errors.Wrapf(err, "failed to query %s", path)
 	}
 
-	return validators, nil
+	if response.Response.Code != 0 {
+		return nil, errors.Errorf("query %s failed with code %d: %s", path, response.Response.Code, response.Response.Log)
+	}
+
+	return response.Response.Value, nil
+}
+
+// GetBlockResults returns the events and transaction results of a block.
+func (c *RPCClient) GetBlockResults(ctx context.Context, height uint64) (*coretypes.ResultBlockResults, error) {
+	h := int64(height)
+	var response *coretypes.ResultBlockResults
+	err := c.do(ctx, "block_results", h, func(ctx context.Context, client *http.HTTP) (err error) {
+		response, err = client.BlockResults(ctx, &h)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get block results %d", height)
+	}
+
+	return response, nil
+}
+
+// SearchBlocks returns the heights of the blocks whose begin or end block
+// events match query, in ascending order. The node must index block events.
+func (c *RPCClient) SearchBlocks(ctx context.Context, query string) ([]uint64, error) {
+	heights := []uint64{}
+	page := 1
+	perPage := searchPerPage
+
+	for {
+		var response *coretypes.ResultBlockSearch
+		err := c.do(ctx, "block_search", 0, func(ctx context.Context, client *http.HTTP) (err error) {
+			response, err = client.BlockSearch(ctx, query, &page, &perPage, "asc")
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to search blocks, page %d", page)
+		}
+
+		for _, block := range response.Blocks {
+			heights = append(heights, uint64(block.Block.Height))
+		}
+
+		if len(heights) >= response.TotalCount || len(response.Blocks) == 0 {
+			return heights, nil
+		}
+
+		page++
+	}
+}
+
+// SearchTxs returns the transactions matching query, in ascending order.
+func (c *RPCClient) SearchTxs(ctx context.Context, query string) ([]*coretypes.ResultTx, error) {
+	txs := []*coretypes.ResultTx{}
+	page := 1
+	perPage := searchPerPage
+
+	for {
+		var response *coretypes.ResultTxSearch
+		err := c.do(ctx, "tx_search", 0, func(ctx context.Context, client *http.HTTP) (err error) {
+			response, err = client.TxSearch(ctx, query, false, &page, &perPage, "asc")
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to search txs, page %d", page)
+		}
+
+		txs = append(txs, response.Txs...)
+
+		if len(txs) >= response.TotalCount || len(response.Txs) == 0 {
+			return txs, nil
+		}
+
+		page++
+	}
 }
 
 func BlockFromJSONResponse(data []byte) (*types.Block, []byte, error) {
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+// Delivery states of a provider validator set change on a consumer. Changes
+// made before the consumer's first set have no state.
+const (
+	deliveryReceived = "received"
+	// deliverySkipped is a change the consumer never applied although it
+	// applied a later one.
+	deliverySkipped = "skipped"
+	// deliveryPending is a change not applied yet, nor any later one.
+	deliveryPending = "pending"
+)
+
+// ConsumerComparison holds the findings of comparing the validator set
+// changes of a consumer with the provider's.
+type ConsumerComparison struct {
+	Consumer       string
+	Updates        []ValsetUpdate
+	Missing        int
+	NotExisted     int
+	OutOfOrder     int
+	HashMismatches int
+	// VSC is the attribution to VSC packets, nil if none are indexed.
+	VSC *VSCReport
+	// Delivery holds the delivery state of each provider change.
+	Delivery []string
+	Findings []Finding
+}
+
+// deliveries returns the delivery state of each provider change on a consumer.
+func deliveries(provider, consumer []ValsetUpdate) []string {
+	states := make([]string, len(provider))
+	if len(consumer) == 0 {
+		return states
+	}
+
+	applied := appliedProviderChanges(provider, consumer)
+	received := map[int]bool{}
+	last := -1
+	for _, i := range applied {
+		received[i] = true
+		if i > last {
+			last = i
+		}
+	}
+
+	for i, p := range provider {
+		switch {
+		case p.Timestamp.Before(consumer[0].Timestamp):
+		case received[i]:
+			states[i] = deliveryReceived
+		case i < last:
+			states[i] = deliverySkipped
+		default:
+			states[i] = deliveryPending
+		}
+	}
+
+	return states
+}
+
+// consumerFinding describes a consumer set change, with its difference to
+// the provider set in effect at the same time.
+func consumerFinding(kind string, chain string, validatorSetProvider []ValsetUpdate, vs ValsetUpdate, detail string) Finding {
+	f := Finding{
+		Type:    kind,
+		Chain:   chain,
+		Height:  vs.Height,
+		Time:    timePtr(vs.Timestamp),
+		Hash:    vs.ValidatorsHash,
+		OldHash: vs.OldValidatorsHash,
+		Detail:  detail,
+	}
+
+	if pvs := activeAt(validatorSetProvider, vs.Timestamp); pvs != nil {
+		diff := pvs.Validators.Diff(vs.Validators)
+		f.ProviderHeight = pvs.Height
+		f.ProviderTime = timePtr(pvs.Timestamp)
+		f.Diff = &diff
+	}
+
+	return f
+}
+
+func mismatchFinding(m ValsetMismatch) Finding {
+	return Finding{
+		Type:         findingHashMismatch,
+		Chain:        m.Chain,
+		Height:       int64(m.Height),
+		Hash:         fmt.Sprintf("%X", m.Computed),
+		ExpectedHash: fmt.Sprintf("%X", m.Header),
+		Detail:       m.String(),
+	}
+}
+
+// compareConsumer compares the consumer's validator set changes with the
+// provider's and returns the findings.
+func compareConsumer(db *Store, consumerName string, validatorSetProvider, validatorSetConsumer []ValsetUpdate, mismatches []ValsetMismatch) (*ConsumerComparison, error) {
+	c := &ConsumerComparison{
+		Consumer:       consumerName,
+		Updates:        validatorSetConsumer,
+		HashMismatches: len(mismatches),
+		Delivery:       deliveries(validatorSetProvider, validatorSetConsumer),
+	}
+
+	log.Infof("Found %d validator hashes in consumer %s", len(validatorSetConsumer), consumerName)
+
+	firstProviderHash := validatorSetProvider[0]
+
+	valset := map[string]ValsetUpdate{}
+
+	for _, vs := range validatorSetProvider {
+		valset[vs.SetHash] = vs
+	}
+
+	for _, vs := range validatorSetConsumer {
+		if vs.Timestamp.Before(firstProviderHash.Timestamp) {
+			// skip validator set updates before provider started
+			continue
+		}
+
+		_, ok := valset[vs.SetHash]
+		if !ok {
+			c.Missing++
+			c.Findings = append(c.Findings, consumerFinding(findingMissing, consumerName, validatorSetProvider, vs, "validator set missing from provider"))
+			continue
+		}
+
+		// check if validator set update exists on provider before timestamp
+		if !existsBeforeTimestamp(validatorSetProvider, vs.SetHash, vs.Timestamp) {
+			c.NotExisted++
+			c.Findings = append(c.Findings, consumerFinding(findingNotExisted, consumerName, validatorSetProvider, vs, "validator set did not exist on provider at that time"))
+			continue
+		}
+
+		if !isInOrder(validatorSetProvider, vs) {
+			c.OutOfOrder++
+			c.Findings = append(c.Findings, consumerFinding(findingOutOfOrder, consumerName, validatorSetProvider, vs, "validator set follows one the provider had after it"))
+		}
+	}
+
+	for i, state := range c.Delivery {
+		if state != deliverySkipped {
+			continue
+		}
+		p := validatorSetProvider[i]
+		c.Findings = append(c.Findings, Finding{
+			Type:           findingSkipped,
+			Chain:          consumerName,
+			ProviderHeight: p.Height,
+			ProviderTime:   timePtr(p.Timestamp),
+			Hash:           p.ValidatorsHash,
+			OldHash:        p.OldValidatorsHash,
+			Detail:         "provider validator set never applied, a later one was",
+		})
+	}
+
+	log.Infof("Found %d missing validator hashes on %s", c.Missing, consumerName)
+	log.Infof("Found %d validator hashes on %s not existed on provider chain at that time", c.NotExisted, consumerName)
+	log.Infof("Found %d out of order validator hashes on %s", c.OutOfOrder, consumerName)
+
+	var vscFound []Finding
+	var err error
+	c.VSC, vscFound, err = vscFindings(db, consumerName, validatorSetProvider, validatorSetConsumer)
+	if err != nil {
+		return nil, err
+	}
+	c.Findings = append(c.Findings, vscFound...)
+
+	for _, mismatch := range mismatches {
+		c.Findings = append(c.Findings, mismatchFinding(mismatch))
+	}
+
+	return c, nil
+}
+
+// vscFindings attributes the consumer's validator set changes to the VSC
+// packets indexed by index vsc. The report is nil if there are none.
+func vscFindings(db *Store, consumerName string, validatorSetProvider, validatorSetConsumer []ValsetUpdate) (*VSCReport, []Finding, error) {
+	consumerPackets, err := db.AllVSCPackets(consumerName)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load consumer VSC packets")
+	}
+	if len(consumerPackets) == 0 {
+		log.Infof("No VSC packets indexed for %s, run index vsc to attribute its validator set changes", consumerName)
+		return nil, nil, nil
+	}
+
+	providerPackets, err := db.AllVSCPackets(providerName)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load provider VSC packets")
+	}
+
+	report := correlateVSC(providerPackets, consumerPackets, validatorSetProvider, validatorSetConsumer)
+	findings := []Finding{}
+
+	mismatched := 0
+	for _, a := range report.Attributions {
+		f := Finding{
+			Chain:          consumerName,
+			Height:         a.Consumer.Height,
+			Time:           timePtr(a.Consumer.Timestamp),
+			ProviderHeight: int64(a.ProviderHeight),
+			VSCID:          a.ID(),
+			Hash:           a.Consumer.ValidatorsHash,
+			OldHash:        a.Consumer.OldValidatorsHash,
+		}
+
+		switch {
+		case a.ProviderHeight == 0:
+			f.Type = findingVSCUnsent
+			f.Detail = fmt.Sprintf("set comes from VSC %d, which no indexed provider block sent", a.ID())
+		case a.Provider == nil:
+			log.Debugf("[vsc] consumer set at block %d comes from VSC %d sent at provider block %d, before the first provider set", a.Consumer.Height, a.ID(), a.ProviderHeight)
+			continue
+		case !a.Matches():
+			mismatched++
+			diff := a.Provider.Validators.Diff(a.Consumer.Validators)
+			f.Type = findingVSCMismatch
+			f.ProviderTime = timePtr(a.Provider.Timestamp)
+			f.Diff = &diff
+			f.Detail = fmt.Sprintf("set comes from VSC %d sent at provider block %d, but differs from the provider set at block %d", a.ID(), a.ProviderHeight, a.Provider.Height)
+		default:
+			log.Debugf("[vsc] consumer set at block %d comes from VSC %d sent at provider block %d", a.Consumer.Height, a.ID(), a.ProviderHeight)
+			continue
+		}
+
+		findings = append(findings, f)
+	}
+
+	for _, vs := range report.Unattributed {
+		findings = append(findings, Finding{
+			Type:    findingVSCUnattributed,
+			Chain:   consumerName,
+			Height:  vs.Height,
+			Time:    timePtr(vs.Timestamp),
+			Hash:    vs.ValidatorsHash,
+			OldHash: vs.OldValidatorsHash,
+			Detail:  fmt.Sprintf("set changed without a VSC packet received at block %d", vs.Height-vscApplyDelay),
+		})
+	}
+	for _, p := range report.Dropped {
+		findings = append(findings, Finding{
+			Type:           findingVSCDropped,
+			Chain:          consumerName,
+			ProviderHeight: int64(p.Height),
+			VSCID:          p.ID,
+			Detail:         fmt.Sprintf("%s sent at provider block %d was never received", p, p.Height),
+		})
+	}
+	for _, p := range report.Reordered {
+		findings = append(findings, Finding{
+			Type:   findingVSCReordered,
+			Chain:  consumerName,
+			Height: int64(p.Height),
+			VSCID:  p.ID,
+			Detail: fmt.Sprintf("%s received after a later VSC", p),
+		})
+	}
+	for _, p := range report.Failed {
+		findings = append(findings, Finding{
+			Type:   findingVSCAckError,
+			Chain:  consumerName,
+			Height: int64(p.Height),
+			VSCID:  p.ID,
+			Detail: fmt.Sprintf("%s acknowledged with error: %s", p, p.AckError),
+		})
+	}
+
+	log.Infof("Attributed %d %s validator set changes to VSC packets, %d differ from the provider set", len(report.Attributions), consumerName, mismatched)
+	log.Infof("Found %d validator set changes without a VSC packet, %d dropped, %d reordered and %d failed VSC packets on %s", len(report.Unattributed), len(report.Dropped), len(report.Reordered), len(report.Failed), consumerName)
+
+	return report, findings, nil
+}
+
+func (c *ConsumerComparison) count(state string) int {
+	n := 0
+	for _, s := range c.Delivery {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+// ComparisonSummary is the per-consumer matrix and the cross-consumer
+// delivery summary of view-missing-validator.
+type ComparisonSummary struct {
+	Consumers []ConsumerSummary `json:"consumers"`
+	Delivery  DeliverySummary   `json:"delivery"`
+}
+
+// ConsumerSummary counts the findings of one consumer. The VSC counts are
+// nil when no VSC packets are indexed.
+type ConsumerSummary struct {
+	Consumer        string `json:"consumer"`
+	Sets            int    `json:"sets"`
+	Missing         int    `json:"missing"`
+	NotExisted      int    `json:"not_existed"`
+	OutOfOrder      int    `json:"out_of_order"`
+	HashMismatches  int    `json:"hash_mismatches"`
+	Received        int    `json:"received"`
+	Skipped         int    `json:"skipped"`
+	Pending         int    `json:"pending"`
+	VSCUnattributed *int   `json:"vsc_unattributed,omitempty"`
+	VSCDropped      *int   `json:"vsc_dropped,omitempty"`
+	VSCReordered    *int   `json:"vsc_reordered,omitempty"`
+}
+
+// DeliverySummary counts the provider changes received by all, some or none
+// of the consumers that existed at the time, and lists the partial ones.
+type DeliverySummary struct {
+	All     int                `json:"all"`
+	Some    int                `json:"some"`
+	None    int                `json:"none"`
+	Partial []ProviderDelivery `json:"partial"`
+}
+
+// ProviderDelivery lists the consumers in each delivery state of a provider change.
+type ProviderDelivery struct {
+	Height   int64     `json:"height"`
+	Time     time.Time `json:"time"`
+	Received []string  `json:"received"`
+	Skipped  []string  `json:"skipped"`
+	Pending  []string  `json:"pending"`
+}
+
+func summarizeComparisons(validatorSetProvider []ValsetUpdate, comparisons []*ConsumerComparison) *ComparisonSummary {
+	summary := &ComparisonSummary{Consumers: []ConsumerSummary{}, Delivery: DeliverySummary{Partial: []ProviderDelivery{}}}
+
+	for _, c := range comparisons {
+		row := ConsumerSummary{
+			Consumer:       c.Consumer,
+			Sets:           len(c.Updates),
+			Missing:        c.Missing,
+			NotExisted:     c.NotExisted,
+			OutOfOrder:     c.OutOfOrder,
+			HashMismatches: c.HashMismatches,
+			Received:       c.count(deliveryReceived),
+			Skipped:        c.count(deliverySkipped),
+			Pending:        c.count(deliveryPending),
+		}
+		if c.VSC != nil {
+			unattributed, dropped, reordered := len(c.VSC.Unattributed), len(c.VSC.Dropped), len(c.VSC.Reordered)
+			row.VSCUnattributed, row.VSCDropped, row.VSCReordered = &unattributed, &dropped, &reordered
+		}
+		summary.Consumers = append(summary.Consumers, row)
+	}
+
+	for i, p := range validatorSetProvider {
+		d := ProviderDelivery{Height: p.Height, Time: p.Timestamp, Received: []string{}, Skipped: []string{}, Pending: []string{}}
+		for _, c := range comparisons {
+			switch c.Delivery[i] {
+			case deliveryReceived:
+				d.Received = append(d.Received, c.Consumer)
+			case deliverySkipped:
+				d.Skipped = append(d.Skipped, c.Consumer)
+			case deliveryPending:
+				d.Pending = append(d.Pending, c.Consumer)
+			}
+		}
+
+		others := len(d.Skipped) + len(d.Pending)
+		switch {
+		case len(d.Received) == 0 && others == 0:
+		case others == 0:
+			summary.Delivery.All++
+		case len(d.Received) == 0:
+			summary.Delivery.None++
+			summary.Delivery.Partial = append(summary.Delivery.Partial, d)
+		default:
+			summary.Delivery.Some++
+			summary.Delivery.Partial = append(summary.Delivery.Partial, d)
+		}
+	}
+
+	return summary
+}
+
+func optionalCount(n *int) string {
+	if n == nil {
+		return "-"
+	}
+	return fmt.Sprint(*n)
+}
+
+// printComparisonMatrix prints one row of findings per consumer.
+func printComparisonMatrix(w io.Writer, summary *ComparisonSummary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "consumer\tsets\tmissing\tnot existed\tout of order\thash mismatch\treceived\tskipped\tpending\tvsc unattributed\tvsc dropped\tvsc reordered\t")
+
+	for _, c := range summary.Consumers {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t\n",
+			c.Consumer, c.Sets, c.Missing, c.NotExisted, c.OutOfOrder, c.HashMismatches,
+			c.Received, c.Skipped, c.Pending, optionalCount(c.VSCUnattributed), optionalCount(c.VSCDropped), optionalCount(c.VSCReordered))
+	}
+
+	tw.Flush()
+}
+
+// printDeliverySummary lists the provider changes that some or none of the
+// consumers received, among the consumers that existed at the time.
+func printDeliverySummary(w io.Writer, delivery DeliverySummary) {
+	fmt.Fprintf(w, "Provider changes received by all consumers: %d, by some: %d, by none: %d\n", delivery.All, delivery.Some, delivery.None)
+
+	for _, d := range delivery.Partial {
+		states := []string{}
+		if len(d.Received) > 0 {
+			states = append(states, "received by "+strings.Join(d.Received, ", "))
+		} else {
+			states = append(states, "received by none")
+		}
+		if len(d.Skipped) > 0 {
+			states = append(states, "skipped by "+strings.Join(d.Skipped, ", "))
+		}
+		if len(d.Pending) > 0 {
+			states = append(states, "pending on "+strings.Join(d.Pending, ", "))
+		}
+		fmt.Fprintf(w, "  provider block %d at %s: %s\n", d.Height, d.Time.Format(time.RFC3339), strings.Join(states, "; "))
+	}
+}
@@ -1,76 +1,143 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/starclusterteam/go-starbox/log"
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tendermint/tendermint/types"
 )
 
 func BlockKey(providerName string, height uint64) []byte {
-	key := fmt.Sprintf("%s:block:%d", providerName, height)
-	return []byte(key)
+	return heightKey(providerName, "block", height)
 }
 
 func EvidenceKey(providerName string, height uint64) []byte {
-	key := fmt.Sprintf("%s:evidence:%d", providerName, height)
-	return []byte(key)
+	return heightKey(providerName, "evidence", height)
 }
 
-func indexBlock(db *leveldb.DB, rpc *RPCClient, height uint64, force bool) error {
-	key := BlockKey(rpc.Name(), height)
-	hasKey, err := db.Has(key, nil)
+func ValidatorsKey(providerName string, height uint64) []byte {
+	return heightKey(providerName, "validatorz", height)
+}
+
+func FailureKey(providerName string, height uint64) []byte {
+	return heightKey(providerName, "failed", height)
+}
+
+// BlockFailure records a height that could not be indexed after all retries.
+type BlockFailure struct {
+	Height    uint64    `json:"height"`
+	Error     string    `json:"error"`
+	Retryable bool      `json:"retryable"`
+	Time      time.Time `json:"time"`
+}
+
+func (s *Store) PutFailure(chain string, height uint64, cause error) error {
+	data, err := json.Marshal(BlockFailure{
+		Height:    height,
+		Error:     cause.Error(),
+		Retryable: isRetryable(cause),
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode failure")
+	}
+
+	return s.Put(FailureKey(chain, height), data)
+}
+
+func (s *Store) DeleteFailure(chain string, height uint64) error {
+	return s.Delete(FailureKey(chain, height))
+}
+
+// Failures returns the recorded failures of a chain, keyed by height.
+func (s *Store) Failures(chain string) (map[uint64]BlockFailure, error) {
+	iter := s.NewIterator(PrefixRange([]byte(chain + ":failed:")))
+	defer iter.Release()
+
+	failures := map[uint64]BlockFailure{}
+	for iter.Next() {
+		var failure BlockFailure
+		if err := json.Unmarshal(iter.Value(), &failure); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode failure %s", iter.Key())
+		}
+		failures[failure.Height] = failure
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate failures")
+	}
+
+	return failures, nil
+}
+
+// indexBlock fetches and stores a block. With headersOnly it stores the
+// compact BlockRecord instead of the full block.
+func indexBlock(ctx context.Context, db *Store, rpc *RPCClient, height uint64, force bool, headersOnly bool) error {
+	hasKey, err := db.HasBlock(rpc.Name(), height)
 	if err != nil {
 		log.Errorf("Failed to check if key exists: %s", err)
 		return errors.Wrap(err, "failed to check if key exists")
 	}
 
 	if hasKey && !force {
-		log.Debugf("Skipping block %d, key already exists: %s", height, key)
+		log.Debugf("Skipping block %d, key already exists: %s", height, BlockKey(rpc.Name(), height))
 		return nil
 	}
 
-	block, evidence, err := rpc.GetBlockByHeight(height)
-	if err != nil {
-		log.Errorf("Failed to get block %d: %s", height, err)
-		return errors.Wrap(err, "failed to get block")
-	}
+	var data, evidence []byte
 
-	data, err := BlockToJSON(block)
+	if headersOnly {
+		var record *BlockRecord
+		record, evidence, err = rpc.GetBlockRecord(ctx, height)
+		if err != nil {
+			log.Errorf("Failed to get block record %d: %s", height, err)
+			return errors.Wrap(err, "failed to get block record")
+		}
+
+		data, err = BlockRecordToJSON(record)
+	} else {
+		var block *types.Block
+		block, evidence, err = rpc.GetBlockByHeight(ctx, height)
+		if err != nil {
+			log.Errorf("Failed to get block %d: %s", height, err)
+			return errors.Wrap(err, "failed to get block")
+		}
+
+		data, err = BlockToJSON(block)
+	}
 	if err != nil {
 		log.Errorf("Failed to encode block %d: %s", height, err)
 		return errors.Wrap(err, "failed to encode block")
 	}
 
-	err = db.Put([]byte(key), data, nil)
+	err = db.PutBlock(rpc.Name(), height, data)
 	if err != nil {
 		log.Errorf("Failed to save block %d: %s", height, err)
 		return errors.Wrap(err, "failed to save block")
 	}
 
 	if evidence != nil {
-		key := fmt.Sprintf("%s:evidence:%d", rpc.Name(), height)
-
-		err = db.Put([]byte(key), evidence, nil)
+		err = db.PutEvidence(rpc.Name(), height, evidence)
 		if err != nil {
 			log.Errorf("Failed to save evidence %d: %s", height, err)
 			return errors.Wrap(err, "failed to save evidence")
 		}
 	}
 
-	log.Infof("Indexed block %d", height)
+	log.Debugf("Indexed block %d", height)
 	return nil
 }
 
-func validatorSetForBlock(db *leveldb.DB, providerName string, height uint64) ([]byte, error) {
-	key := BlockKey(providerName, height)
-	data, err := db.Get(key, nil)
+func validatorSetForBlock(db *Store, providerName string, height uint64) ([]byte, error) {
+	data, err := db.Block(providerName, height)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get block")
 	}
 
-	block, err := BlockFromJSON(data)
+	block, err := BlockRecordFromJSON(data)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to decode block")
 	}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/config"
+	"github.com/starclusterteam/go-starbox/log"
+	"github.com/tendermint/tendermint/rpc/client/http"
+)
+
+// EndpointConfig controls how the endpoints of a chain are health checked.
+type EndpointConfig struct {
+	// HealthInterval is how often the status of every endpoint is refreshed.
+	HealthInterval time.Duration
+	// Cooldown is how long an endpoint stays out of rotation after a failure.
+	Cooldown time.Duration
+	// MaxLag is how many blocks an endpoint may be behind the highest one.
+	MaxLag int64
+}
+
+func endpointConfigFromEnv() (EndpointConfig, error) {
+	cfg := EndpointConfig{
+		MaxLag: int64(config.Int("RPC_MAX_LAG", 10)),
+	}
+
+	var err error
+	if cfg.HealthInterval, err = config.Duration("RPC_HEALTH_INTERVAL", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.Cooldown, err = config.Duration("RPC_ENDPOINT_COOLDOWN", 30*time.Second); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+var errNoHealthyEndpoint = errors.New("no healthy endpoint")
+
+// parseAddrs splits a comma separated list of RPC addresses.
+func parseAddrs(s string) []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+type endpoint struct {
+	addr   string
+	client *http.HTTP
+
+	mu        sync.Mutex
+	downUntil time.Time
+	latest    int64
+	earliest  int64
+}
+
+func (e *endpoint) markDown(cooldown time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.downUntil = time.Now().Add(cooldown)
+}
+
+func (e *endpoint) state() (up bool, earliest, latest int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().After(e.downUntil), e.earliest, e.latest
+}
+
+// endpointPool spreads requests over the endpoints of a chain, skipping the
+// ones that are down, lagging behind or pruned below the requested height.
+type endpointPool struct {
+	endpoints []*endpoint
+	cfg       EndpointConfig
+	next      uint32
+
+	refreshMu sync.Mutex
+	checkedAt time.Time
+}
+
+// refresh updates the status of every endpoint if the last check is older
+// than the health interval.
+func (p *endpointPool) refresh(ctx context.Context, timeout time.Duration, force bool) {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	if !force && time.Since(p.checkedAt) < p.cfg.HealthInterval {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			status, err := e.client.Status(ctx)
+			if err != nil {
+				if ctx.Err() == context.Canceled {
+					return
+				}
+				log.Warningf("endpoint %s is unhealthy: %s", e.addr, err)
+				e.markDown(p.cfg.Cooldown)
+				return
+			}
+
+			e.mu.Lock()
+			e.latest = status.SyncInfo.LatestBlockHeight
+			e.earliest = status.SyncInfo.EarliestBlockHeight
+			e.downUntil = time.Time{}
+			e.mu.Unlock()
+		}(e)
+	}
+	wg.Wait()
+
+	p.checkedAt = time.Now()
+}
+
+// latest returns the highest block height reported by a healthy endpoint.
+func (p *endpointPool) latest() (int64, error) {
+	var latest int64
+	for _, e := range p.endpoints {
+		up, _, l := e.state()
+		if up && l > latest {
+			latest = l
+		}
+	}
+
+	if latest == 0 {
+		return 0, errNoHealthyEndpoint
+	}
+
+	return latest, nil
+}
+
+// earliest returns the lowest height retained by a healthy endpoint.
+func (p *endpointPool) earliest() (int64, error) {
+	var earliest int64
+	for _, e := range p.endpoints {
+		up, ea, l := e.state()
+		if up && l > 0 && (earliest == 0 || ea < earliest) {
+			earliest = ea
+		}
+	}
+
+	if earliest == 0 {
+		return 0, errNoHealthyEndpoint
+	}
+
+	return earliest, nil
+}
+
+// pick returns the next endpoint able to serve height, or any height if it is 0.
+// Endpoints in tried are only used when nothing else is left.
+func (p *endpointPool) pick(height int64, tried map[*endpoint]bool) *endpoint {
+	var maxLatest int64
+	for _, e := range p.endpoints {
+		if up, _, l := e.state(); up && l > maxLatest {
+			maxLatest = l
+		}
+	}
+
+	candidates := []*endpoint{}
+	for _, e := range p.endpoints {
+		up, earliest, latest := e.state()
+		if !up || tried[e] {
+			continue
+		}
+		if latest > 0 && latest < maxLatest-p.cfg.MaxLag {
+			continue
+		}
+		if height > 0 && (earliest > height || (latest > 0 && latest < height)) {
+			continue
+		}
+		candidates = append(candidates, e)
+	}
+
+	if len(candidates) == 0 {
+		// nothing fits, fall back to plain round robin over untried endpoints
+		for _, e := range p.endpoints {
+			if !tried[e] {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	i := atomic.AddUint32(&p.next, 1)
+	return candidates[int(i)%len(candidates)]
+}
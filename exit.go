@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+// Exit codes. When several apply, the highest one is used.
+const (
+	exitSuccess = 0
+	// exitFindings means the analysis found more than the --fail-on thresholds allow.
+	exitFindings = 1
+	// exitPartial means some data could not be indexed or is not indexed yet,
+	// so the results are incomplete.
+	exitPartial = 2
+	exitFatal   = 3
+	// exitInterrupted is used when the command is stopped by a signal.
+	exitInterrupted = 130
+)
+
+const exitCodesHelp = `Exit codes:
+  0  success
+  1  findings over the --fail-on thresholds
+  2  partial data: blocks failed to index or are not indexed yet
+  3  fatal error
+`
+
+// ExitError ends the program with Code instead of exitFatal.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+func partialData(err error) error {
+	return &ExitError{Code: exitPartial, Err: err}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitSuccess
+	}
+
+	var exit *ExitError
+	if errors.As(err, &exit) {
+		return exit.Code
+	}
+
+	return exitFatal
+}
+
+// FailOn maps finding types to how many findings of that type are tolerated.
+// An empty FailOn tolerates none of any type.
+type FailOn map[string]int
+
+// addFailOnFlag adds --fail-on to an analysis command. Without defaults any
+// finding fails the command.
+func addFailOnFlag(cmd *cobra.Command, defaults ...string) {
+	usage := "Exit with code 1 only when there are more findings of a type than allowed, as type or type=count; \"any\" counts every type"
+	if len(defaults) == 0 {
+		usage += " (default: any finding)"
+	}
+	cmd.Flags().StringSlice("fail-on", defaults, usage)
+}
+
+func failOnThresholds(cmd *cobra.Command) (FailOn, error) {
+	values, _ := cmd.Flags().GetStringSlice("fail-on")
+	return parseFailOn(values)
+}
+
+func parseFailOn(values []string) (FailOn, error) {
+	failOn := FailOn{}
+
+	for _, value := range values {
+		kind, count := value, 0
+		if i := strings.Index(value, "="); i >= 0 {
+			kind = value[:i]
+			n, err := strconv.Atoi(value[i+1:])
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("invalid --fail-on count in %q", value)
+			}
+			count = n
+		}
+
+		known := kind == findingAny
+		for _, t := range findingTypes {
+			known = known || t == kind
+		}
+		if !known {
+			return nil, errors.Errorf("unknown finding type %q in --fail-on, expected %s or one of %s", kind, findingAny, strings.Join(findingTypes, ", "))
+		}
+
+		failOn[kind] = count
+	}
+
+	return failOn, nil
+}
+
+// Exceeded describes the thresholds the findings go over.
+func (f FailOn) Exceeded(findings []Finding) []string {
+	if len(f) == 0 {
+		if len(findings) == 0 {
+			return nil
+		}
+		return []string{fmt.Sprintf("%d findings", len(findings))}
+	}
+
+	counts := map[string]int{findingAny: len(findings)}
+	for _, finding := range findings {
+		counts[finding.Type]++
+	}
+
+	exceeded := []string{}
+	for kind, allowed := range f {
+		if counts[kind] > allowed {
+			exceeded = append(exceeded, fmt.Sprintf("%d %s findings, %d allowed", counts[kind], kind, allowed))
+		}
+	}
+	sort.Strings(exceeded)
+
+	return exceeded
+}
+
+// checkFindings returns the error the analysis command ends with: partial if
+// the data is incomplete, otherwise an exitFindings error if the findings go
+// over failOn.
+func checkFindings(findings []Finding, failOn FailOn, partial error) error {
+	exceeded := failOn.Exceeded(findings)
+
+	if partial != nil {
+		if len(exceeded) > 0 {
+			log.Warningf("Found %s", strings.Join(exceeded, "; "))
+		}
+		return partial
+	}
+
+	if len(exceeded) > 0 {
+		return &ExitError{Code: exitFindings, Err: errors.Errorf("found %s", strings.Join(exceeded, "; "))}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseFailOn(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   FailOn
+		err    bool
+	}{
+		{"unset", nil, FailOn{}, false},
+		{"type", []string{"missing"}, FailOn{"missing": 0}, false},
+		{"counts", []string{"skipped=5", "any=10"}, FailOn{"skipped": 5, "any": 10}, false},
+		{"unknown type", []string{"bogus"}, nil, true},
+		{"negative count", []string{"missing=-1"}, nil, true},
+		{"invalid count", []string{"missing=x"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFailOn(tt.values)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %t", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailOnExceeded(t *testing.T) {
+	findings := []Finding{{Type: findingMissing}, {Type: findingSkipped}, {Type: findingSkipped}, {Type: findingLatencyOutlier}}
+
+	tests := []struct {
+		name     string
+		failOn   FailOn
+		findings []Finding
+		want     int
+	}{
+		{"any finding by default", FailOn{}, findings, 1},
+		{"no findings", FailOn{}, nil, 0},
+		{"within thresholds", FailOn{findingMissing: 1, findingSkipped: 2}, findings, 0},
+		{"over thresholds", FailOn{findingMissing: 0, findingSkipped: 1}, findings, 2},
+		{"unlisted types are ignored", FailOn{findingLatencySLA: 0}, findings, 0},
+		{"total", FailOn{findingAny: 3}, findings, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.failOn.Exceeded(tt.findings); len(got) != tt.want {
+				t.Errorf("got %v, want %d thresholds exceeded", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFindings(t *testing.T) {
+	findings := []Finding{{Type: findingMissing}}
+	partial := partialChains([]string{"gopher"})
+
+	tests := []struct {
+		name     string
+		findings []Finding
+		partial  error
+		want     int
+	}{
+		{"clean", nil, nil, exitSuccess},
+		{"findings", findings, nil, exitFindings},
+		{"partial", nil, partial, exitPartial},
+		{"partial wins over findings", findings, partial, exitPartial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkFindings(tt.findings, FailOn{}, tt.partial)
+			if got := exitCode(errors.Wrap(err, "wrapped")); got != tt.want {
+				t.Errorf("exit code %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if got := exitCode(errors.New("failed")); got != exitFatal {
+		t.Errorf("exit code of a plain error is %d, want %d", got, exitFatal)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+const (
+	exportFormat  = "vset-detect-export"
+	exportVersion = 1
+)
+
+// exportKinds are the keys that are exported for every chain, in order.
+var exportKinds = []string{"block", "validatorz", "evidence"}
+
+// ExportRecord is one line of an export: the header, a stored value or the
+// trailer. Stored values keep their JSON encoding in Data, with its SHA-256.
+type ExportRecord struct {
+	Kind   string          `json:"kind"`
+	Chain  string          `json:"chain,omitempty"`
+	Height uint64          `json:"height,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	SHA256 string          `json:"sha256,omitempty"`
+
+	// header
+	Format        string     `json:"format,omitempty"`
+	Version       int        `json:"version,omitempty"`
+	SchemaVersion int        `json:"schema_version,omitempty"`
+	Created       *time.Time `json:"created,omitempty"`
+	Chains        []string   `json:"chains,omitempty"`
+	From          uint64     `json:"from,omitempty"`
+	To            uint64     `json:"to,omitempty"`
+
+	// trailer, Records counts the value records and Digest is the SHA-256
+	// of every line before it
+	Records uint64 `json:"records,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// ExportOptions selects what is exported. A zero To means no upper bound.
+type ExportOptions struct {
+	Chains []string
+	From   uint64
+	To     uint64
+}
+
+func (o ExportOptions) heights() HeightRange {
+	r := HeightRange{From: o.From, To: o.To}
+	if r.To == 0 {
+		r.To = math.MaxUint64
+	}
+	return r
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// exportWriter writes the lines of an export and keeps the running digest.
+type exportWriter struct {
+	w       *bufio.Writer
+	digest  hash.Hash
+	records uint64
+}
+
+func (e *exportWriter) write(record *ExportRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// keep Data byte for byte, so it still matches its checksum
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(record); err != nil {
+		return errors.Wrap(err, "failed to encode record")
+	}
+	line := buf.Bytes()
+
+	e.digest.Write(line)
+
+	_, err := e.w.Write(line)
+	return err
+}
+
+func (e *exportWriter) writeValue(kind, chain string, height uint64, data []byte) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return errors.Wrapf(err, "%s %d of %s is not valid JSON", kind, height, chain)
+	}
+
+	err := e.write(&ExportRecord{
+		Kind:   kind,
+		Chain:  chain,
+		Height: height,
+		Data:   compact.Bytes(),
+		SHA256: sha256Hex(compact.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	e.records++
+	return nil
+}
+
+// exportDB writes the selected data as gzip-compressed JSON lines to path,
+// along with a path.sha256 checksum file. The export is written to a
+// temporary file that only replaces path once it is complete.
+func exportDB(ctx context.Context, db *Store, path string, opts ExportOptions) (uint64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create file")
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	fileDigest := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(file, fileDigest))
+	e := &exportWriter{w: bufio.NewWriter(gz), digest: sha256.New()}
+
+	now := time.Now().UTC()
+	err = e.write(&ExportRecord{
+		Kind:          "header",
+		Format:        exportFormat,
+		Version:       exportVersion,
+		SchemaVersion: schemaVersion,
+		Created:       &now,
+		Chains:        opts.Chains,
+		From:          opts.From,
+		To:            opts.To,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	heights := opts.heights()
+
+	for _, chain := range opts.Chains {
+		for _, kind := range exportKinds {
+			count, err := exportHeights(ctx, db, e, chain, kind, heights)
+			if err != nil {
+				return e.records, err
+			}
+			log.Infof("Exported %d %s records of %s", count, kind, chain)
+		}
+
+		progress, err := db.Progress(chain)
+		if err != nil {
+			return e.records, err
+		}
+		if progress = progress.Clip(heights); progress != nil {
+			data, err := json.Marshal(progress)
+			if err != nil {
+				return e.records, errors.Wrap(err, "failed to encode progress")
+			}
+			if err := e.writeValue("progress", chain, 0, data); err != nil {
+				return e.records, err
+			}
+		}
+	}
+
+	records := e.records
+	err = e.write(&ExportRecord{
+		Kind:    "trailer",
+		Records: records,
+		Digest:  hex.EncodeToString(e.digest.Sum(nil)),
+	})
+	if err != nil {
+		return records, err
+	}
+
+	if err := e.w.Flush(); err != nil {
+		return records, errors.Wrap(err, "failed to write export")
+	}
+	if err := gz.Close(); err != nil {
+		return records, errors.Wrap(err, "failed to write export")
+	}
+	if err := file.Close(); err != nil {
+		return records, errors.Wrap(err, "failed to write export")
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return records, errors.Wrap(err, "failed to rename export")
+	}
+
+	// same format as sha256sum, so `sha256sum -c` can check the file after a transfer
+	checksum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(fileDigest.Sum(nil)), filepath.Base(path))
+	if err := os.WriteFile(path+".sha256", []byte(checksum), 0644); err != nil {
+		return records, errors.Wrap(err, "failed to write checksum file")
+	}
+
+	return records, nil
+}
+
+func exportHeights(ctx context.Context, db *Store, e *exportWriter, chain, kind string, heights HeightRange) (uint64, error) {
+	iter := db.Heights(chain, kind, heights.From, heights.To)
+	defer iter.Release()
+
+	var count uint64
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		_, _, height, ok := parseHeightKey(iter.Key())
+		if !ok {
+			continue
+		}
+
+		if err := e.writeValue(kind, chain, height, iter.Value()); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if err := iter.Error(); err != nil {
+		return count, errors.Wrapf(err, "failed to iterate %s of %s", kind, chain)
+	}
+
+	return count, nil
+}
+
+// readExport calls fn with every value record of the export at path, after
+// checking the header. The checksums of the records and the trailer are
+// verified as the file is read, so a caller that must not act on a damaged
+// export reads it twice.
+func readExport(ctx context.Context, path string, fn func(record *ExportRecord) error) (*ExportRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open export")
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress export")
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	digest := sha256.New()
+
+	var header *ExportRecord
+	var records uint64
+
+	for line := 1; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return nil, errors.New("export is truncated: missing trailer")
+		}
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "failed to read export")
+		}
+
+		record := &ExportRecord{}
+		if err := json.Unmarshal(bytes.TrimSpace(data), record); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode line %d", line)
+		}
+
+		switch {
+		case line == 1:
+			if record.Kind != "header" || record.Format != exportFormat {
+				return nil, errors.New("not a vset-detect export")
+			}
+			if record.Version != exportVersion {
+				return nil, errors.Errorf("unsupported export version %d", record.Version)
+			}
+			if record.SchemaVersion != schemaVersion {
+				return nil, errors.Errorf("export has schema version %d, expected %d", record.SchemaVersion, schemaVersion)
+			}
+			header = record
+
+		case record.Kind == "trailer":
+			if record.Records != records {
+				return nil, errors.Errorf("export has %d records, trailer says %d", records, record.Records)
+			}
+			if sum := hex.EncodeToString(digest.Sum(nil)); record.Digest != sum {
+				return nil, errors.Errorf("export digest mismatch: got %s, trailer says %s", sum, record.Digest)
+			}
+			return header, nil
+
+		default:
+			if sum := sha256Hex(record.Data); sum != record.SHA256 {
+				return nil, errors.Errorf("checksum mismatch on line %d (%s %s %d)", line, record.Kind, record.Chain, record.Height)
+			}
+			if err := fn(record); err != nil {
+				return nil, err
+			}
+			records++
+		}
+
+		digest.Write(data)
+	}
+}
+
+// importDB verifies the export at path and then writes its records to the
+// database. Imported progress is merged with the progress already stored.
+func importDB(ctx context.Context, db *Store, path string) (uint64, error) {
+	var total uint64
+	_, err := readExport(ctx, path, func(record *ExportRecord) error {
+		if record.Kind != "progress" && !isExportKind(record.Kind) {
+			return errors.Errorf("unknown record kind %q", record.Kind)
+		}
+		total++
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to verify export")
+	}
+
+	reporter := NewProgressReporter("import", "records", total)
+	defer reporter.Stop()
+
+	batch := new(Batch)
+	flush := func() error {
+		if err := db.Write(batch); err != nil {
+			return errors.Wrap(err, "failed to write batch")
+		}
+		reporter.Add(uint64(batch.Len()))
+		batch.Reset()
+		return nil
+	}
+
+	_, err = readExport(ctx, path, func(record *ExportRecord) error {
+		if record.Kind == "progress" {
+			// the heights the progress covers must be stored first
+			if err := flush(); err != nil {
+				return err
+			}
+			reporter.Add(1)
+			return importProgress(db, record)
+		}
+
+		batch.Put(heightKey(record.Chain, record.Kind, record.Height), record.Data)
+		if batch.Len() >= migrateBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := flush(); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func isExportKind(kind string) bool {
+	for _, k := range exportKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func importProgress(db *Store, record *ExportRecord) error {
+	imported := &ChainProgress{}
+	if err := json.Unmarshal(record.Data, imported); err != nil {
+		return errors.Wrapf(err, "failed to decode progress of %s", record.Chain)
+	}
+
+	progress, err := db.Progress(record.Chain)
+	if err != nil {
+		return err
+	}
+
+	return db.PutProgress(record.Chain, progress.Merge(imported))
+}
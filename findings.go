@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Finding types.
+const (
+	// findingMissing is a consumer set the provider never had.
+	findingMissing = "missing"
+	// findingNotExisted is a consumer set the provider only had later.
+	findingNotExisted = "not_existed"
+	// findingOutOfOrder is a consumer set that followed a set the provider had after it.
+	findingOutOfOrder = "out_of_order"
+	// findingHashMismatch is a validator set whose hash differs from its header.
+	findingHashMismatch = "hash_mismatch"
+	// findingSkipped is a provider change a consumer never applied, although it applied a later one.
+	findingSkipped = "skipped"
+
+	findingVSCUnattributed = "vsc_unattributed"
+	findingVSCUnsent       = "vsc_unsent"
+	findingVSCMismatch     = "vsc_mismatch"
+	findingVSCDropped      = "vsc_dropped"
+	findingVSCReordered    = "vsc_reordered"
+	findingVSCAckError     = "vsc_ack_error"
+
+	findingLatencyOutlier = "latency_outlier"
+	findingLatencySLA     = "latency_sla"
+)
+
+// findingAny is the --fail-on key that counts findings of every type.
+const findingAny = "any"
+
+var findingTypes = []string{
+	findingMissing, findingNotExisted, findingOutOfOrder, findingHashMismatch, findingSkipped,
+	findingVSCUnattributed, findingVSCUnsent, findingVSCMismatch, findingVSCDropped, findingVSCReordered, findingVSCAckError,
+	findingLatencyOutlier, findingLatencySLA,
+}
+
+// Output formats of the analysis commands.
+const (
+	outputTable  = "table"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+	outputCSV    = "csv"
+)
+
+var outputFormats = []string{outputTable, outputJSON, outputNDJSON, outputCSV}
+
+// Finding is one problem found by an analysis command. Chain and Height
+// locate it; the provider fields point at the provider change it relates to.
+type Finding struct {
+	Type           string     `json:"type"`
+	Chain          string     `json:"chain"`
+	Height         int64      `json:"height,omitempty"`
+	Time           *time.Time `json:"time,omitempty"`
+	ProviderHeight int64      `json:"provider_height,omitempty"`
+	ProviderTime   *time.Time `json:"provider_time,omitempty"`
+	VSCID          uint64     `json:"vsc_id,omitempty"`
+	// Hash and OldHash are the validators hashes of the set and the one
+	// before it; for hash mismatches Hash is the computed hash and
+	// ExpectedHash the header's.
+	Hash         string      `json:"hash,omitempty"`
+	OldHash      string      `json:"old_hash,omitempty"`
+	ExpectedHash string      `json:"expected_hash,omitempty"`
+	Blocks       uint64      `json:"blocks,omitempty"`
+	Duration     float64     `json:"duration_seconds,omitempty"`
+	Diff         *ValsetDiff `json:"diff,omitempty"`
+	Detail       string      `json:"detail"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Report is the JSON output of an analysis command.
+type Report struct {
+	Findings []Finding   `json:"findings"`
+	Summary  interface{} `json:"summary,omitempty"`
+}
+
+// addOutputFlag adds --output to an analysis command.
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringP("output", "o", outputTable, "Output format: "+strings.Join(outputFormats, ", "))
+}
+
+func outputFormat(cmd *cobra.Command) (string, error) {
+	format, _ := cmd.Flags().GetString("output")
+	for _, f := range outputFormats {
+		if f == format {
+			return format, nil
+		}
+	}
+	return "", errors.Errorf("unknown output format %q, expected one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+// writeReport writes the findings in format. summary goes into the JSON
+// report; printSummary prints it after the findings table.
+func writeReport(w io.Writer, format string, findings []Finding, summary interface{}, printSummary func(w io.Writer)) error {
+	if findings == nil {
+		findings = []Finding{}
+	}
+
+	switch format {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(Report{Findings: findings, Summary: summary})
+
+	case outputNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, f := range findings {
+			if err := encoder.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case outputCSV:
+		return writeFindingsCSV(w, findings)
+	}
+
+	if err := writeFindingsTable(w, findings); err != nil {
+		return err
+	}
+	if printSummary != nil {
+		printSummary(w)
+	}
+	return nil
+}
+
+var findingsCSVHeader = []string{
+	"type", "chain", "height", "time", "provider_height", "provider_time", "vsc_id",
+	"hash", "old_hash", "expected_hash", "blocks", "duration_seconds", "diff", "detail",
+}
+
+func writeFindingsCSV(w io.Writer, findings []Finding) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(findingsCSVHeader); err != nil {
+		return err
+	}
+
+	for _, f := range findings {
+		diff := ""
+		if f.Diff != nil {
+			diff = strings.ReplaceAll(f.Diff.String(), "\n", "; ")
+		}
+
+		err := cw.Write([]string{
+			f.Type,
+			f.Chain,
+			formatInt(f.Height),
+			formatTime(f.Time),
+			formatInt(f.ProviderHeight),
+			formatTime(f.ProviderTime),
+			formatInt(int64(f.VSCID)),
+			f.Hash,
+			f.OldHash,
+			f.ExpectedHash,
+			formatInt(int64(f.Blocks)),
+			formatSeconds(f.Duration),
+			diff,
+			f.Detail,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeFindingsTable(w io.Writer, findings []Finding) error {
+	if len(findings) == 0 {
+		_, err := fmt.Fprintln(w, "No findings")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tCHAIN\tHEIGHT\tTIME\tPROVIDER HEIGHT\tDETAIL")
+
+	for _, f := range findings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Type, f.Chain, formatInt(f.Height), formatTime(f.Time), formatInt(f.ProviderHeight), f.Detail)
+		if f.Diff != nil {
+			for _, line := range strings.Split(f.Diff.String(), "\n") {
+				fmt.Fprintf(tw, "\t\t\t\t\t  %s\n", line)
+			}
+		}
+	}
+
+	return tw.Flush()
+}
+
+func formatInt(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprint(n)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatSeconds(s float64) string {
+	if s == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g", s)
+}
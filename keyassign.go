@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcutil/bech32"
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Provider queries listing the consensus address pairs of a consumer chain.
+// Older ICS versions take the consumer chain ID as field 1, newer ones the
+// consumer ID the provider assigned to the chain. Both return the pairs as
+// field 1.
+const (
+	pairsByChainIDQuery    = "/interchain_security.ccv.provider.v1.Query/QueryAllPairsValConAddrByConsumerChainID"
+	pairsByConsumerIDQuery = "/interchain_security.ccv.provider.v1.Query/QueryAllPairsValConsAddrByConsumer"
+)
+
+// KeyAssignment maps the consensus addresses validators use on a consumer
+// chain to their provider addresses, both upper case hex. Validators that
+// did not assign a key use their provider address and are not listed.
+type KeyAssignment map[string]string
+
+type keyAssignmentPair struct {
+	ProviderAddress string `json:"provider_address"`
+	ConsumerAddress string `json:"consumer_address"`
+}
+
+// KeyAssignmentHistory returns the key assignment of a consumer chain as it
+// was at a provider height, so that rotated keys and validators that left
+// the set are translated with the pairs in effect at the time.
+type KeyAssignmentHistory struct {
+	provider *RPCClient
+	consumer *ChainConfig
+	// file is set when the pairs come from a file, they apply at every height
+	file    KeyAssignment
+	heights map[int64]KeyAssignment
+	// latest is used at the heights whose state the provider has pruned
+	latest KeyAssignment
+}
+
+// loadKeyAssignment returns the key assignment of a consumer chain, read
+// from the file if one is given, otherwise queried from the provider at
+// each height it is needed.
+func loadKeyAssignment(db *Store, consumer *ChainConfig, file string) (*KeyAssignmentHistory, error) {
+	if file != "" {
+		keys, err := loadKeyAssignmentFile(file)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded %d assigned consumer keys of %s", len(keys), consumer.Name)
+		log.Warningf("The key assignment file of %s applies to every height, keys rotated since and validators that left the set are not translated", consumer.Name)
+
+		return &KeyAssignmentHistory{file: keys}, nil
+	}
+
+	if consumer.ChainID == "" && consumer.ConsumerID == "" {
+		return nil, errors.Errorf("chain_id or consumer_id of %s is required to query its key assignment", consumer.Name)
+	}
+
+	provider, err := NewRPCClient(cfg.Provider.Endpoints, providerName, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create RPC client")
+	}
+
+	return &KeyAssignmentHistory{provider: provider, consumer: consumer, heights: map[int64]KeyAssignment{}}, nil
+}
+
+// At returns the key assignment at a provider height, or the latest one if
+// height is 0 or its state is pruned.
+func (h *KeyAssignmentHistory) At(ctx context.Context, height int64) (KeyAssignment, error) {
+	if h.file != nil {
+		return h.file, nil
+	}
+
+	if keys, ok := h.heights[height]; ok {
+		return keys, nil
+	}
+
+	keys, err := queryKeyAssignment(ctx, h.provider, h.consumer, height)
+	if err != nil {
+		if ctx.Err() != nil || height == 0 {
+			return nil, err
+		}
+
+		if h.latest == nil {
+			log.Warningf("Failed to query the key assignment of %s at provider height %d, using the latest one where the state is pruned: %s", h.consumer.Name, height, err)
+			h.latest, err = h.At(ctx, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		keys = h.latest
+	}
+
+	h.heights[height] = keys
+	return keys, nil
+}
+
+// Translate replaces the consumer addresses of every change with provider
+// addresses, using the key assignment at the provider change in effect when
+// the consumer set changed.
+func (h *KeyAssignmentHistory) Translate(ctx context.Context, consumer, provider []ValsetUpdate) ([]ValsetUpdate, error) {
+	if h == nil {
+		return consumer, nil
+	}
+
+	translated := make([]ValsetUpdate, 0, len(consumer))
+	lastSetHash := ""
+
+	for _, update := range consumer {
+		var height int64
+		if pvs := activeAt(provider, update.Timestamp); pvs != nil {
+			height = pvs.Height
+		} else if len(provider) > 0 {
+			height = provider[0].Height
+		}
+
+		keys, err := h.At(ctx, height)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get key assignment at provider height %d", height)
+		}
+
+		update.Validators = keys.Translate(update.Validators)
+		update.SetHash = update.Validators.Hash()
+		update.OldSetHash = lastSetHash
+		lastSetHash = update.SetHash
+
+		translated = append(translated, update)
+	}
+
+	return translated, nil
+}
+
+// loadKeyAssignmentFile reads address pairs from a JSON file, either a list
+// of {provider_address, consumer_address} objects or the output of
+// `<provider binary> query provider all-pairs-valconsensus-address -o json`.
+// Addresses can be bech32 or hex.
+func loadKeyAssignmentFile(path string) (KeyAssignment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key assignment file")
+	}
+
+	var pairs []keyAssignmentPair
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		var response struct {
+			Pairs []keyAssignmentPair `json:"pair_val_con_addr"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, errors.Wrap(err, "failed to parse key assignment file")
+		}
+		pairs = response.Pairs
+	}
+
+	return newKeyAssignment(pairs)
+}
+
+// queryKeyAssignment fetches the address pairs of a consumer chain from the
+// provider's ccv/provider module at height, or the latest state if 0. Newer
+// providers only answer the query by consumer ID, which must be configured.
+func queryKeyAssignment(ctx context.Context, provider *RPCClient, consumer *ChainConfig, height int64) (KeyAssignment, error) {
+	path, field := pairsByChainIDQuery, consumer.ChainID
+	if consumer.ConsumerID != "" {
+		path, field = pairsByConsumerIDQuery, consumer.ConsumerID
+	}
+
+	request := protowire.AppendTag(nil, 1, protowire.BytesType)
+	request = protowire.AppendString(request, field)
+
+	response, err := provider.ABCIQuery(ctx, path, request, height)
+	if err != nil {
+		if consumer.ConsumerID == "" {
+			return nil, errors.Wrapf(err, "failed to query key assignment of %s, set its consumer_id on providers that assign consumer IDs, or key_assignment_file", consumer.Name)
+		}
+		return nil, errors.Wrapf(err, "failed to query key assignment of %s", consumer.Name)
+	}
+
+	pairs, err := decodeKeyAssignmentPairs(response)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyAssignment(pairs)
+}
+
+// decodeKeyAssignmentPairs decodes the repeated PairValConAddrProviderAndConsumer
+// of the query response: provider_address is field 1, consumer_address field 2.
+func decodeKeyAssignmentPairs(data []byte) ([]keyAssignmentPair, error) {
+	pairs := []keyAssignmentPair{}
+
+	err := walkProto(data, func(num protowire.Number, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		pair := keyAssignmentPair{}
+		err := walkProto(value, func(num protowire.Number, value []byte) error {
+			switch num {
+			case 1:
+				pair.ProviderAddress = string(value)
+			case 2:
+				pair.ConsumerAddress = string(value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		pairs = append(pairs, pair)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode key assignment response")
+	}
+
+	return pairs, nil
+}
+
+// walkProto calls fn with the number and value of every length-delimited
+// field of a protobuf message and skips the others.
+func walkProto(data []byte, fn func(num protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newKeyAssignment(pairs []keyAssignmentPair) (KeyAssignment, error) {
+	keys := KeyAssignment{}
+
+	for _, pair := range pairs {
+		provider, err := parseConsAddress(pair.ProviderAddress)
+		if err != nil {
+			return nil, err
+		}
+		consumer, err := parseConsAddress(pair.ConsumerAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		if consumer != provider {
+			keys[consumer] = provider
+		}
+	}
+
+	return keys, nil
+}
+
+// parseConsAddress returns a bech32 or hex consensus address as upper case hex.
+func parseConsAddress(address string) (string, error) {
+	if raw, err := hex.DecodeString(address); err == nil {
+		return strings.ToUpper(hex.EncodeToString(raw)), nil
+	}
+
+	_, raw, err := bech32.DecodeToBase256(address)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid consensus address %q", address)
+	}
+
+	return strings.ToUpper(hex.EncodeToString(raw)), nil
+}
+
+// Translate returns the set with consumer addresses replaced by provider addresses.
+func (k KeyAssignment) Translate(set ValidatorSet) ValidatorSet {
+	if len(k) == 0 {
+		return set
+	}
+
+	translated := make(ValidatorSet, 0, len(set))
+	for _, v := range set {
+		if provider, ok := k[v.Address]; ok {
+			v.Address = provider
+		}
+		translated = append(translated, v)
+	}
+
+	sort.Slice(translated, func(i, j int) bool {
+		return translated[i].Address < translated[j].Address
+	})
+
+	return translated
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Histogram bucket upper bounds for VSC latencies.
+var (
+	latencyBlockBuckets    = []float64{1, 2, 3, 5, 10, 20, 50, 100}
+	latencyDurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// VSCLatency is how long a provider validator set change took to become
+// active on a consumer.
+type VSCLatency struct {
+	Provider ValsetUpdate
+	// Consumer is the consumer set change that applied it, nil if the
+	// consumer never did.
+	Consumer *ValsetUpdate
+	// Superseded is set when the consumer went straight to a later provider set.
+	Superseded bool
+	// Blocks counts the consumer blocks from the first one at or after the
+	// provider change up to the one where the set became active. For pending
+	// changes it runs up to the last indexed consumer block.
+	Blocks   uint64
+	Duration time.Duration
+}
+
+func (l VSCLatency) Pending() bool {
+	return l.Consumer == nil && !l.Superseded
+}
+
+// consumerBlocks answers time questions about the indexed blocks of a consumer.
+type consumerBlocks struct {
+	db    *Store
+	chain string
+	// from and to bound the contiguous indexed heights.
+	from, to uint64
+}
+
+func (b *consumerBlocks) time(height uint64) (time.Time, error) {
+	data, err := b.db.Block(b.chain, height)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to get block %d of %s", height, b.chain)
+	}
+
+	record, err := BlockRecordFromJSON(data)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to decode block %d of %s", height, b.chain)
+	}
+
+	return record.Time, nil
+}
+
+// firstAtOrAfter returns the first height from from on whose block time is
+// not before t, or to+1 if there is none.
+func (b *consumerBlocks) firstAtOrAfter(from uint64, t time.Time) (uint64, error) {
+	lo, hi := from, b.to+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		blockTime, err := b.time(mid)
+		if err != nil {
+			return 0, err
+		}
+		if blockTime.Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// appliedProviderChanges returns, for each consumer set change, the index of
+// the provider change it applies: the latest one with the same set before
+// it, or -1 if there is none.
+func appliedProviderChanges(provider, consumer []ValsetUpdate) []int {
+	byHash := map[string][]int{}
+	for i, p := range provider {
+		byHash[p.SetHash] = append(byHash[p.SetHash], i)
+	}
+
+	applied := make([]int, len(consumer))
+	for j, c := range consumer {
+		applied[j] = -1
+		for _, i := range byHash[c.SetHash] {
+			if provider[i].Timestamp.After(c.Timestamp) {
+				break
+			}
+			applied[j] = i
+		}
+	}
+
+	return applied
+}
+
+// measureLatency matches every provider set change with the first consumer
+// change that applied it. A consumer set applies the latest provider change
+// with the same set before it; a consumer that applies a later change first
+// has skipped the earlier one. Provider changes from before the consumer's
+// first set are left out.
+func measureLatency(provider, consumer []ValsetUpdate, blocks *consumerBlocks) ([]VSCLatency, error) {
+	if len(consumer) == 0 {
+		return nil, nil
+	}
+
+	applied := appliedProviderChanges(provider, consumer)
+
+	tipTime, err := blocks.time(blocks.to)
+	if err != nil {
+		return nil, err
+	}
+
+	latencies := []VSCLatency{}
+
+	for i, p := range provider {
+		if p.Timestamp.Before(consumer[0].Timestamp) {
+			continue
+		}
+
+		l := VSCLatency{Provider: p}
+
+		first := sort.Search(len(consumer), func(j int) bool {
+			return !consumer[j].Timestamp.Before(p.Timestamp)
+		})
+
+		from := blocks.from
+		if first > 0 {
+			from = uint64(consumer[first-1].Height)
+		}
+		start, err := blocks.firstAtOrAfter(from, p.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := first; j < len(consumer); j++ {
+			if applied[j] < i {
+				continue
+			}
+			if applied[j] > i {
+				l.Superseded = true
+				break
+			}
+
+			l.Consumer = &consumer[j]
+			l.Blocks = uint64(consumer[j].Height) - start
+			l.Duration = consumer[j].Timestamp.Sub(p.Timestamp)
+			break
+		}
+
+		if l.Pending() {
+			if start <= blocks.to {
+				l.Blocks = blocks.to - start + 1
+			}
+			l.Duration = tipTime.Sub(p.Timestamp)
+		}
+
+		latencies = append(latencies, l)
+	}
+
+	return latencies, nil
+}
+
+// LatencySLA bounds how long a provider change may take to reach a
+// consumer. Zero fields are not checked.
+type LatencySLA struct {
+	Blocks   uint64
+	Duration time.Duration
+}
+
+func (s LatencySLA) Set() bool {
+	return s.Blocks > 0 || s.Duration > 0
+}
+
+// Exceeded reports whether l is over the SLA. Pending changes count once
+// they have waited longer than it allows.
+func (s LatencySLA) Exceeded(l VSCLatency) bool {
+	if l.Superseded {
+		return false
+	}
+	return (s.Blocks > 0 && l.Blocks > s.Blocks) || (s.Duration > 0 && l.Duration > s.Duration)
+}
+
+func (s LatencySLA) String() string {
+	limits := []string{}
+	if s.Blocks > 0 {
+		limits = append(limits, fmt.Sprintf("%d blocks", s.Blocks))
+	}
+	if s.Duration > 0 {
+		limits = append(limits, s.Duration.String())
+	}
+	return strings.Join(limits, ", ")
+}
+
+// Distribution summarizes a set of measurements.
+type Distribution struct {
+	sorted []float64
+}
+
+func NewDistribution(values []float64) Distribution {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	return Distribution{sorted: sorted}
+}
+
+func (d Distribution) Len() int {
+	return len(d.sorted)
+}
+
+// Percentile returns the nearest-rank percentile p, between 0 and 100.
+func (d Distribution) Percentile(p float64) float64 {
+	if len(d.sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(d.sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return d.sorted[rank-1]
+}
+
+func (d Distribution) Max() float64 {
+	return d.Percentile(100)
+}
+
+// OutlierFence is the value above which a measurement is an outlier: the
+// third quartile plus 1.5 times the interquartile range.
+func (d Distribution) OutlierFence() float64 {
+	q1, q3 := d.Percentile(25), d.Percentile(75)
+	return q3 + 1.5*(q3-q1)
+}
+
+// Histogram counts the values up to each bound, plus the values above the
+// last one.
+func (d Distribution) Histogram(bounds []float64) []int {
+	counts := make([]int, len(bounds)+1)
+	for _, v := range d.sorted {
+		i := sort.SearchFloat64s(bounds, v)
+		counts[i]++
+	}
+	return counts
+}
+
+// LatencySummary is the VSC latency report of a consumer.
+type LatencySummary struct {
+	Consumer   string          `json:"consumer"`
+	Changes    int             `json:"changes"`
+	Applied    int             `json:"applied"`
+	Superseded int             `json:"superseded"`
+	Pending    []PendingChange `json:"pending"`
+	// Blocks and Duration are nil when no change was applied.
+	Blocks   *LatencyStats      `json:"blocks,omitempty"`
+	Duration *LatencyStats      `json:"duration_seconds,omitempty"`
+	SLA      *LatencySLASummary `json:"sla,omitempty"`
+	// Partial is set when the consumer is not indexed up to the requested block.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// PendingChange is a provider change the consumer has not applied yet.
+type PendingChange struct {
+	ProviderHeight int64     `json:"provider_height"`
+	ProviderTime   time.Time `json:"provider_time"`
+	Blocks         uint64    `json:"blocks"`
+	Duration       float64   `json:"duration_seconds"`
+}
+
+// LatencyStats summarizes a latency distribution.
+type LatencyStats struct {
+	P50          float64           `json:"p50"`
+	P90          float64           `json:"p90"`
+	P99          float64           `json:"p99"`
+	Max          float64           `json:"max"`
+	OutlierFence float64           `json:"outlier_fence"`
+	Histogram    []HistogramBucket `json:"histogram"`
+}
+
+// HistogramBucket counts the values up to UpTo and above the previous
+// bucket. The last bucket has no upper bound and an UpTo of 0.
+type HistogramBucket struct {
+	UpTo  float64 `json:"up_to,omitempty"`
+	Count int     `json:"count"`
+}
+
+type LatencySLASummary struct {
+	Blocks   uint64  `json:"blocks,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+	Exceeded int     `json:"exceeded"`
+}
+
+func newLatencyStats(d Distribution, bounds []float64) *LatencyStats {
+	stats := &LatencyStats{
+		P50:          d.Percentile(50),
+		P90:          d.Percentile(90),
+		P99:          d.Percentile(99),
+		Max:          d.Max(),
+		OutlierFence: d.OutlierFence(),
+	}
+
+	for i, count := range d.Histogram(bounds) {
+		bucket := HistogramBucket{Count: count}
+		if i < len(bounds) {
+			bucket.UpTo = bounds[i]
+		}
+		stats.Histogram = append(stats.Histogram, bucket)
+	}
+
+	return stats
+}
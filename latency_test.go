@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tendermint/tendermint/types"
+)
+
+func providerUpdate(height int64, seconds int, set string) ValsetUpdate {
+	return ValsetUpdate{
+		Height:    height,
+		Timestamp: testGenesis.Add(time.Duration(seconds) * time.Second),
+		SetHash:   set,
+	}
+}
+
+func TestAppliedProviderChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider []ValsetUpdate
+		consumer []ValsetUpdate
+		want     []int
+	}{
+		{
+			name:     "each set once",
+			provider: []ValsetUpdate{providerUpdate(100, 0, "0"), providerUpdate(110, 10, "A"), providerUpdate(120, 20, "B")},
+			consumer: []ValsetUpdate{testUpdate(1, "0", ""), testUpdate(12, "A", "0"), testUpdate(22, "B", "A")},
+			want:     []int{0, 1, 2},
+		},
+		{
+			name:     "set seen again later",
+			provider: []ValsetUpdate{providerUpdate(100, 0, "A"), providerUpdate(110, 10, "B"), providerUpdate(120, 20, "A")},
+			consumer: []ValsetUpdate{testUpdate(2, "A", ""), testUpdate(12, "B", "A"), testUpdate(22, "A", "B")},
+			want:     []int{0, 1, 2},
+		},
+		{
+			name:     "set the provider never had",
+			provider: []ValsetUpdate{providerUpdate(100, 0, "A")},
+			consumer: []ValsetUpdate{testUpdate(2, "A", ""), testUpdate(12, "X", "A")},
+			want:     []int{0, -1},
+		},
+		{
+			name:     "set the provider only had later",
+			provider: []ValsetUpdate{providerUpdate(100, 0, "A"), providerUpdate(110, 30, "B")},
+			consumer: []ValsetUpdate{testUpdate(2, "A", ""), testUpdate(12, "B", "A")},
+			want:     []int{0, -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appliedProviderChanges(tt.provider, tt.consumer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeasureLatency(t *testing.T) {
+	db := newTestStore(t)
+	// consumer block h is at h seconds
+	storeTestBlocks(t, db, "gopher", 1, 50, map[uint64][]*types.Validator{1: testValidators(10)})
+	blocks := &consumerBlocks{db: db, chain: "gopher", from: 1, to: 50}
+
+	provider := []ValsetUpdate{
+		providerUpdate(90, 0, "0"),
+		providerUpdate(100, 10, "A"),
+		providerUpdate(110, 20, "B"),
+		providerUpdate(120, 25, "C"),
+		providerUpdate(130, 40, "D"),
+	}
+	consumer := []ValsetUpdate{testUpdate(1, "0", ""), testUpdate(12, "A", "0"), testUpdate(30, "C", "A")}
+
+	latencies, err := measureLatency(provider, consumer, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type latency struct {
+		ProviderHeight int64
+		ConsumerHeight int64
+		Superseded     bool
+		Blocks         uint64
+		Duration       time.Duration
+	}
+	want := []latency{
+		{100, 12, false, 2, 2 * time.Second},
+		{110, 0, true, 0, 0},
+		{120, 30, false, 5, 5 * time.Second},
+		// pending up to the last indexed block
+		{130, 0, false, 11, 10 * time.Second},
+	}
+
+	got := []latency{}
+	for _, l := range latencies {
+		var consumerHeight int64
+		if l.Consumer != nil {
+			consumerHeight = l.Consumer.Height
+		}
+		got = append(got, latency{l.Provider.Height, consumerHeight, l.Superseded, l.Blocks, l.Duration})
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !latencies[3].Pending() || latencies[1].Pending() {
+		t.Errorf("only the last change should be pending")
+	}
+}
+
+func TestLatencySLAExceeded(t *testing.T) {
+	tests := []struct {
+		name    string
+		sla     LatencySLA
+		latency VSCLatency
+		want    bool
+	}{
+		{"within", LatencySLA{Blocks: 10, Duration: time.Minute}, VSCLatency{Blocks: 10, Duration: time.Minute}, false},
+		{"over blocks", LatencySLA{Blocks: 10}, VSCLatency{Blocks: 11}, true},
+		{"over duration", LatencySLA{Duration: time.Minute}, VSCLatency{Blocks: 100, Duration: 2 * time.Minute}, true},
+		{"unset", LatencySLA{}, VSCLatency{Blocks: 100, Duration: time.Hour}, false},
+		{"superseded", LatencySLA{Blocks: 1}, VSCLatency{Superseded: true, Blocks: 100}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sla.Exceeded(tt.latency); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	d := NewDistribution([]float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1})
+
+	percentiles := map[float64]float64{0: 1, 25: 3, 50: 5, 90: 9, 99: 10, 100: 10}
+	for p, want := range percentiles {
+		if got := d.Percentile(p); got != want {
+			t.Errorf("p%g is %g, want %g", p, got, want)
+		}
+	}
+
+	if got := d.OutlierFence(); got != 15.5 {
+		t.Errorf("outlier fence is %g, want 15.5", got)
+	}
+
+	if got := d.Histogram([]float64{2, 5}); !reflect.DeepEqual(got, []int{2, 3, 5}) {
+		t.Errorf("histogram is %v, want [2 3 5]", got)
+	}
+
+	if got := NewDistribution(nil).Percentile(50); got != 0 {
+		t.Errorf("empty p50 is %g, want 0", got)
+	}
+}
@@ -1,43 +1,89 @@
 package main
 
 import (
-	"strconv"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/starclusterteam/go-starbox/config"
 	"github.com/starclusterteam/go-starbox/log"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
-var dbFile string
+// cfg is the chain configuration, loaded before any command runs.
+var cfg *Config
 
-var providerAddr string
-var providerMinHeight uint64
+var rpcRetry RetryConfig
+var rpcEndpoints EndpointConfig
+
+// progressLogInterval is how often progress is logged when not on a terminal.
+var progressLogInterval time.Duration
 
 func init() {
 	var err error
 
-	providerAddr = config.String("PROVIDER_ADDR", "http://localhost:26657")
-	providerMinHeightStr := config.String("PROVIDER_MIN_HEIGHT", "1")
+	rpcRetry, err = retryConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
 
-	providerMinHeight, err = strconv.ParseUint(providerMinHeightStr, 10, 64)
+	rpcEndpoints, err = endpointConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
 
+	progressLogInterval, err = config.Duration("PROGRESS_INTERVAL", 30*time.Second)
 	if err != nil {
 		panic(err)
 	}
+}
 
-	dbFile = config.String("DB_FILE", "database.db")
+func newDB() (*Store, error) {
+	return openDB(false)
 }
 
-func newDB() (*leveldb.DB, error) {
-	return leveldb.OpenFile(dbFile, nil)
+// newReadOnlyDB opens the database for the query commands, which can run
+// while an indexer holds it open.
+func newReadOnlyDB() (*Store, error) {
+	return openDB(true)
+}
+
+func openDB(readOnly bool) (*Store, error) {
+	db, err := openStore(cfg.DBBackend, cfg.DBFile, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
 }
 
 func main() {
 	mainCmd := &cobra.Command{
 		Use:   "vset-detect",
 		Short: "Detects validator set changes",
+		Long:  "Detects validator set changes\n\n" + exitCodesHelp,
+		// errors are logged by main, with the exit code they map to
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// the arguments are parsed, later errors are not usage errors
+			cmd.SilenceUsage = true
+
+			configFile, _ := cmd.Flags().GetString("config")
+			required := cmd.Flags().Changed("config") || config.String("CONFIG_FILE", "") != ""
+
+			var err error
+			cfg, err = loadConfig(configFile, required)
+			return err
+		},
 	}
+	mainCmd.PersistentFlags().String("config", config.String("CONFIG_FILE", "chains.yaml"), "Chain configuration file")
 
 	indexCmd := &cobra.Command{
 		Use:   "index",
@@ -56,15 +102,67 @@ func main() {
 		RunE:  indexConsumer,
 	}
 
+	for _, cmd := range []*cobra.Command{indexProviderCmd, indexConsumerCmd} {
+		cmd.Flags().Bool("follow", false, "Keep indexing new blocks after the backfill")
+		cmd.Flags().Duration("poll-interval", 5*time.Second, "How often to poll for new blocks in follow mode")
+		cmd.Flags().Int("workers", 0, "Number of blocks fetched in parallel (default: the chain's concurrency)")
+		cmd.Flags().Bool("headers-only", false, "Store only headers, commits and evidence instead of full blocks (default: the chain's headers_only)")
+		cmd.Flags().Float64("rps", 0, "Maximum RPC requests per second (default: the chain's rps, unlimited if unset)")
+	}
+
 	viewMissingValidatorCmd := &cobra.Command{
-		Use:   "view-missing-validator",
-		Short: "View missing validator",
+		Use:   "view-missing-validator [consumer...]",
+		Short: "Compares the provider's validator sets with every consumer, or the given ones",
 		RunE:  viewMissingValidator,
 	}
 	viewMissingValidatorCmd.Flags().Uint64("toBlock", 0, "Latest block to query")
+	addOutputFlag(viewMissingValidatorCmd)
+	addFailOnFlag(viewMissingValidatorCmd)
+	viewMissingValidatorCmd.Flags().String("key-assignment-file", "", "JSON file with the consumer's provider_address/consumer_address pairs, with a single consumer (default: the chain's key_assignment_file, or query the provider)")
+
+	vscLatencyCmd := &cobra.Command{
+		Use:   "vsc-latency [consumer...]",
+		Short: "Measures how long provider validator set changes take to become active on consumers",
+		RunE:  vscLatency,
+	}
+	vscLatencyCmd.Flags().Uint64("toBlock", 0, "Latest block to query")
+	vscLatencyCmd.Flags().Uint64("sla-blocks", 0, "Report changes that take more consumer blocks (default: the chain's sla_blocks)")
+	vscLatencyCmd.Flags().Duration("sla-latency", 0, "Report changes that take longer (default: the chain's sla_latency)")
+	addOutputFlag(vscLatencyCmd)
+	// outliers are reported, only SLA breaches fail by default
+	addFailOnFlag(vscLatencyCmd, findingLatencySLA)
+
+	valsetHistoryCmd := &cobra.Command{
+		Use:   "valset-history <chain>",
+		Short: "Lists the stored validator set changes of a chain as CSV",
+		RunE:  valsetHistory,
+	}
+	valsetHistoryCmd.Flags().Uint64("from", 0, "First height")
+	valsetHistoryCmd.Flags().Uint64("to", 0, "Last height (default: no limit)")
+	valsetHistoryCmd.Flags().String("since", "", "Earliest change time, RFC 3339")
+	valsetHistoryCmd.Flags().String("until", "", "Latest change time, RFC 3339")
+
+	indexStatusCmd := &cobra.Command{
+		Use:   "status <chain>",
+		Short: "Shows indexed and missing height ranges of a chain",
+		RunE:  indexStatus,
+	}
+
+	indexVSCCmd := &cobra.Command{
+		Use:   "vsc <chain>",
+		Short: "Indexes the VSC packets sent by the provider or received by a consumer",
+		RunE:  indexVSC,
+	}
+	indexVSCCmd.Flags().Uint64("from", 0, "First height to index (default: the chain's min height)")
+	indexVSCCmd.Flags().Uint64("to", 0, "Last height to index (default: the latest block)")
+	indexVSCCmd.Flags().Bool("scan", false, "Read the block results of every height instead of searching the node's event index")
+	indexVSCCmd.Flags().Int("workers", 0, "Number of block results fetched in parallel with --scan (default: the chain's concurrency)")
+	indexVSCCmd.Flags().Float64("rps", 0, "Maximum RPC requests per second (default: the chain's rps, unlimited if unset)")
 
 	indexCmd.AddCommand(indexProviderCmd)
 	indexCmd.AddCommand(indexConsumerCmd)
+	indexCmd.AddCommand(indexStatusCmd)
+	indexCmd.AddCommand(indexVSCCmd)
 
 	getBlockCmd := &cobra.Command{
 		Use:   "get-block <chain> <block height>",
@@ -84,13 +182,78 @@ func main() {
 		RunE:  evidence,
 	}
 
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Database maintenance",
+	}
+
+	dbMigrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Rewrites the database to the current schema version",
+		RunE:  dbMigrate,
+	}
+
+	dbCompactCmd := &cobra.Command{
+		Use:   "compact",
+		Short: "Compacts the database, optionally dropping block data",
+		RunE:  dbCompact,
+	}
+	dbCompactCmd.Flags().Bool("headers-only", false, "Convert full blocks to headers, commits and evidence presence")
+
+	dbExportCmd := &cobra.Command{
+		Use:   "export <file>",
+		Short: "Exports blocks, validator sets, evidence and progress as gzip-compressed JSON lines",
+		RunE:  dbExport,
+	}
+	dbExportCmd.Flags().StringSlice("chain", nil, "Chains to export (default: every configured chain)")
+	dbExportCmd.Flags().Uint64("from", 0, "First height to export")
+	dbExportCmd.Flags().Uint64("to", 0, "Last height to export (default: no limit)")
+
+	dbImportCmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Verifies and imports a database export",
+		RunE:  dbImport,
+	}
+
+	dbVerifyCmd := &cobra.Command{
+		Use:   "verify [chain...]",
+		Short: "Checks that stored blocks decode, link up and match their cached validator sets",
+		RunE:  dbVerify,
+	}
+	dbVerifyCmd.Flags().Bool("quarantine", false, "Move bad entries to quarantine keys and mark their heights as missing")
+	dbVerifyCmd.Flags().Bool("refetch", false, "Fetch bad entries again from the chain's endpoints")
+
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbCompactCmd)
+	dbCmd.AddCommand(dbExportCmd)
+	dbCmd.AddCommand(dbImportCmd)
+	dbCmd.AddCommand(dbVerifyCmd)
+
+	mainCmd.AddCommand(dbCmd)
 	mainCmd.AddCommand(getBlockCmd)
 	mainCmd.AddCommand(indexCmd)
 	mainCmd.AddCommand(validatorSetCmd)
 	mainCmd.AddCommand(evidenceCmd)
 	mainCmd.AddCommand(viewMissingValidatorCmd)
+	mainCmd.AddCommand(vscLatencyCmd)
+	mainCmd.AddCommand(valsetHistoryCmd)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := mainCmd.ExecuteContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			log.Infof("Interrupted")
+			stop()
+			os.Exit(exitInterrupted)
+		}
 
-	if err := mainCmd.Execute(); err != nil {
-		log.PanicExit(err)
+		code := exitCode(err)
+		if code == exitFatal {
+			log.Errorf("%+v", err)
+		} else {
+			log.Errorf("%s", err)
+		}
+		os.Exit(code)
 	}
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// HeightRange is an inclusive range of block heights.
+type HeightRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+func (r HeightRange) Len() uint64 {
+	return r.To - r.From + 1
+}
+
+func (r HeightRange) String() string {
+	if r.From == r.To {
+		return fmt.Sprintf("%d", r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// ChainProgress records which heights of a chain are indexed: every height
+// between MinHeight and Watermark is stored, except the ones in Missing.
+// Unavailable holds the requested heights that the chain's endpoints have
+// pruned; they are neither fetched nor reported as missing.
+type ChainProgress struct {
+	MinHeight   uint64        `json:"min_height"`
+	Watermark   uint64        `json:"watermark"`
+	Missing     []HeightRange `json:"missing"`
+	Unavailable []HeightRange `json:"unavailable,omitempty"`
+}
+
+func ProgressKey(chain string) []byte {
+	key := fmt.Sprintf("%s:progress", chain)
+	return []byte(key)
+}
+
+// Progress returns the stored progress of a chain, or nil if it was never indexed.
+func (s *Store) Progress(chain string) (*ChainProgress, error) {
+	data, err := s.Get(ProgressKey(chain))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get progress")
+	}
+
+	progress := &ChainProgress{}
+	if err := json.Unmarshal(data, progress); err != nil {
+		return nil, errors.Wrap(err, "failed to decode progress")
+	}
+
+	return progress, nil
+}
+
+func (s *Store) PutProgress(chain string, progress *ChainProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode progress")
+	}
+
+	if err := s.Put(ProgressKey(chain), data); err != nil {
+		return errors.Wrap(err, "failed to save progress")
+	}
+
+	return nil
+}
+
+// Covered returns the ranges that are indexed.
+func (p *ChainProgress) Covered() []HeightRange {
+	if p == nil || p.Watermark == 0 || p.Watermark < p.MinHeight {
+		return nil
+	}
+
+	return subtractRanges([]HeightRange{{From: p.MinHeight, To: p.Watermark}}, append(p.Missing, p.Unavailable...))
+}
+
+// Plan returns the ranges between minHeight and latest that still need to be fetched.
+func (p *ChainProgress) Plan(minHeight, latest uint64) []HeightRange {
+	if latest < minHeight {
+		return nil
+	}
+
+	skip := p.Covered()
+	if p != nil {
+		skip = append(skip, p.Unavailable...)
+	}
+
+	return subtractRanges([]HeightRange{{From: minHeight, To: latest}}, skip)
+}
+
+// Record returns the progress after indexing the given plan, where failed
+// holds the heights that could not be indexed.
+func (p *ChainProgress) Record(plan []HeightRange, failed []uint64) *ChainProgress {
+	covered := p.Covered()
+	covered = append(covered, subtractRanges(plan, rangesFromHeights(failed))...)
+	covered = mergeRanges(covered)
+
+	if len(covered) == 0 {
+		return p
+	}
+
+	next := &ChainProgress{
+		MinHeight: covered[0].From,
+		Watermark: covered[len(covered)-1].To,
+	}
+	next.Missing = subtractRanges([]HeightRange{{From: next.MinHeight, To: next.Watermark}}, covered)
+
+	if p != nil {
+		next.Unavailable = subtractRanges(p.Unavailable, covered)
+		next.Missing = subtractRanges(next.Missing, next.Unavailable)
+	}
+
+	return next
+}
+
+// WithUnavailable returns the progress with the heights from minHeight up to
+// earliest marked as unavailable. Heights from earliest on that were
+// unavailable before are dropped, so they get planned again.
+func (p *ChainProgress) WithUnavailable(minHeight, earliest uint64) *ChainProgress {
+	next := &ChainProgress{}
+	if p != nil {
+		*next = *p
+	}
+
+	unavailable := []HeightRange{}
+	for _, r := range next.Unavailable {
+		if r.From >= earliest {
+			continue
+		}
+		if r.To >= earliest {
+			r.To = earliest - 1
+		}
+		unavailable = append(unavailable, r)
+	}
+	if minHeight < earliest {
+		unavailable = append(unavailable, HeightRange{From: minHeight, To: earliest - 1})
+	}
+
+	next.Unavailable = subtractRanges(unavailable, next.Covered())
+	next.Missing = subtractRanges(next.Missing, next.Unavailable)
+
+	return next
+}
+
+// Clip returns the progress restricted to the heights in r.
+func (p *ChainProgress) Clip(r HeightRange) *ChainProgress {
+	if p == nil {
+		return nil
+	}
+
+	return progressFromCoverage(intersectRanges(p.Covered(), r), intersectRanges(p.Unavailable, r))
+}
+
+// Merge returns the progress covering the indexed heights of both p and other.
+func (p *ChainProgress) Merge(other *ChainProgress) *ChainProgress {
+	if p == nil {
+		return other
+	}
+	if other == nil {
+		return p
+	}
+
+	covered := mergeRanges(append(p.Covered(), other.Covered()...))
+	unavailable := subtractRanges(append(append([]HeightRange{}, p.Unavailable...), other.Unavailable...), covered)
+
+	return progressFromCoverage(covered, unavailable)
+}
+
+// WithMissing returns the progress with heights no longer indexed.
+func (p *ChainProgress) WithMissing(heights []uint64) *ChainProgress {
+	if p == nil {
+		return nil
+	}
+
+	return progressFromCoverage(subtractRanges(p.Covered(), rangesFromHeights(heights)), p.Unavailable)
+}
+
+// progressFromCoverage builds the progress whose indexed heights are covered.
+func progressFromCoverage(covered, unavailable []HeightRange) *ChainProgress {
+	covered = mergeRanges(covered)
+	unavailable = mergeRanges(unavailable)
+
+	if len(covered) == 0 {
+		if len(unavailable) == 0 {
+			return nil
+		}
+		return &ChainProgress{Unavailable: unavailable}
+	}
+
+	next := &ChainProgress{
+		MinHeight:   covered[0].From,
+		Watermark:   covered[len(covered)-1].To,
+		Unavailable: unavailable,
+	}
+	next.Missing = subtractRanges([]HeightRange{{From: next.MinHeight, To: next.Watermark}}, append(covered, unavailable...))
+
+	return next
+}
+
+// MissingCount returns the number of heights below the watermark that are not indexed.
+func (p *ChainProgress) MissingCount() uint64 {
+	return countHeights(p.Missing)
+}
+
+func countHeights(ranges []HeightRange) uint64 {
+	var count uint64
+	for _, r := range ranges {
+		count += r.Len()
+	}
+	return count
+}
+
+// mergeRanges sorts ranges and joins the ones that overlap or touch.
+func mergeRanges(ranges []HeightRange) []HeightRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sorted := make([]HeightRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].From < sorted[j].From
+	})
+
+	merged := []HeightRange{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.From <= last.To+1 {
+			if r.To > last.To {
+				last.To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// subtractRanges returns the heights in ranges that are not in remove.
+func subtractRanges(ranges []HeightRange, remove []HeightRange) []HeightRange {
+	result := mergeRanges(ranges)
+
+	for _, rm := range mergeRanges(remove) {
+		next := []HeightRange{}
+		for _, r := range result {
+			if rm.To < r.From || rm.From > r.To {
+				next = append(next, r)
+				continue
+			}
+			if rm.From > r.From {
+				next = append(next, HeightRange{From: r.From, To: rm.From - 1})
+			}
+			if rm.To < r.To {
+				next = append(next, HeightRange{From: rm.To + 1, To: r.To})
+			}
+		}
+		result = next
+	}
+
+	return result
+}
+
+// intersectRanges returns the heights in ranges that are also in r.
+func intersectRanges(ranges []HeightRange, r HeightRange) []HeightRange {
+	result := []HeightRange{}
+	for _, x := range mergeRanges(ranges) {
+		if x.To < r.From || x.From > r.To {
+			continue
+		}
+		if x.From < r.From {
+			x.From = r.From
+		}
+		if x.To > r.To {
+			x.To = r.To
+		}
+		result = append(result, x)
+	}
+	return result
+}
+
+func rangesFromHeights(heights []uint64) []HeightRange {
+	ranges := make([]HeightRange, 0, len(heights))
+	for _, h := range heights {
+		ranges = append(ranges, HeightRange{From: h, To: h})
+	}
+	return mergeRanges(ranges)
+}
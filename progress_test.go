@@ -0,0 +1,188 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sameRanges compares ranges, with nil and empty equal.
+func sameRanges(a, b []HeightRange) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func sameProgress(a, b *ChainProgress) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.MinHeight == b.MinHeight && a.Watermark == b.Watermark &&
+		sameRanges(a.Missing, b.Missing) && sameRanges(a.Unavailable, b.Unavailable)
+}
+
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []HeightRange
+		want   []HeightRange
+	}{
+		{"empty", nil, nil},
+		{"unsorted", []HeightRange{{10, 12}, {1, 3}}, []HeightRange{{1, 3}, {10, 12}}},
+		{"touching", []HeightRange{{1, 3}, {4, 6}}, []HeightRange{{1, 6}}},
+		{"overlapping", []HeightRange{{1, 5}, {3, 4}, {5, 8}}, []HeightRange{{1, 8}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeRanges(tt.ranges); !sameRanges(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []HeightRange
+		remove []HeightRange
+		want   []HeightRange
+	}{
+		{"nothing removed", []HeightRange{{1, 10}}, nil, []HeightRange{{1, 10}}},
+		{"middle", []HeightRange{{1, 10}}, []HeightRange{{4, 5}}, []HeightRange{{1, 3}, {6, 10}}},
+		{"edges", []HeightRange{{1, 10}}, []HeightRange{{1, 1}, {10, 12}}, []HeightRange{{2, 9}}},
+		{"everything", []HeightRange{{1, 10}}, []HeightRange{{0, 20}}, []HeightRange{}},
+		{"disjoint", []HeightRange{{1, 3}}, []HeightRange{{5, 6}}, []HeightRange{{1, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subtractRanges(tt.ranges, tt.remove); !sameRanges(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainProgressRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress *ChainProgress
+		plan     []HeightRange
+		failed   []uint64
+		want     *ChainProgress
+	}{
+		{
+			name: "first run",
+			plan: []HeightRange{{1, 100}},
+			want: &ChainProgress{MinHeight: 1, Watermark: 100},
+		},
+		{
+			name:   "failed blocks become missing",
+			plan:   []HeightRange{{1, 100}},
+			failed: []uint64{10, 11, 50},
+			want:   &ChainProgress{MinHeight: 1, Watermark: 100, Missing: []HeightRange{{10, 11}, {50, 50}}},
+		},
+		{
+			name:     "retried gap is filled",
+			progress: &ChainProgress{MinHeight: 1, Watermark: 100, Missing: []HeightRange{{10, 11}, {50, 50}}},
+			plan:     []HeightRange{{10, 11}, {50, 50}, {101, 120}},
+			failed:   []uint64{50},
+			want:     &ChainProgress{MinHeight: 1, Watermark: 120, Missing: []HeightRange{{50, 50}}},
+		},
+		{
+			name:   "failed first block",
+			plan:   []HeightRange{{1, 10}},
+			failed: []uint64{1},
+			want:   &ChainProgress{MinHeight: 2, Watermark: 10},
+		},
+		{
+			name:     "nothing indexed",
+			progress: nil,
+			plan:     []HeightRange{{1, 2}},
+			failed:   []uint64{1, 2},
+			want:     nil,
+		},
+		{
+			name:     "unavailable heights are kept",
+			progress: &ChainProgress{Unavailable: []HeightRange{{1, 9}}},
+			plan:     []HeightRange{{10, 20}},
+			want:     &ChainProgress{MinHeight: 10, Watermark: 20, Unavailable: []HeightRange{{1, 9}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.Record(tt.plan, tt.failed); !sameProgress(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainProgressWithUnavailable(t *testing.T) {
+	tests := []struct {
+		name      string
+		progress  *ChainProgress
+		minHeight uint64
+		earliest  uint64
+		want      []HeightRange
+	}{
+		{"nothing pruned", nil, 1, 1, []HeightRange{}},
+		{"pruned below earliest", nil, 1, 100, []HeightRange{{1, 99}}},
+		{
+			name:      "indexed heights stay indexed",
+			progress:  &ChainProgress{MinHeight: 1, Watermark: 50},
+			minHeight: 1,
+			earliest:  100,
+			want:      []HeightRange{{51, 99}},
+		},
+		{
+			name:      "heights available again are dropped",
+			progress:  &ChainProgress{Unavailable: []HeightRange{{1, 99}}},
+			minHeight: 1,
+			earliest:  50,
+			want:      []HeightRange{{1, 49}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.progress.WithUnavailable(tt.minHeight, tt.earliest)
+			if !sameRanges(got.Unavailable, tt.want) {
+				t.Errorf("unavailable %v, want %v", got.Unavailable, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainProgressPlan(t *testing.T) {
+	progress := &ChainProgress{
+		MinHeight:   10,
+		Watermark:   100,
+		Missing:     []HeightRange{{40, 45}},
+		Unavailable: []HeightRange{{1, 9}},
+	}
+
+	tests := []struct {
+		name      string
+		progress  *ChainProgress
+		minHeight uint64
+		latest    uint64
+		want      []HeightRange
+	}{
+		{"never indexed", nil, 1, 10, []HeightRange{{1, 10}}},
+		{"gaps and new blocks", progress, 1, 120, []HeightRange{{40, 45}, {101, 120}}},
+		{"up to date", &ChainProgress{MinHeight: 1, Watermark: 100}, 1, 100, []HeightRange{}},
+		{"latest below min height", progress, 50, 10, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.Plan(tt.minHeight, tt.latest); !sameRanges(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
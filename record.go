@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+	"github.com/tendermint/tendermint/types"
+)
+
+// emptyEvidenceHash is the EvidenceHash of a header whose block has no evidence.
+var emptyEvidenceHash = types.EvidenceList{}.Hash()
+
+// BlockRecord is the compact form of a stored block: the header, the commit
+// of the previous block and whether the block carried evidence. It decodes
+// from both compact records and full blocks.
+type BlockRecord struct {
+	types.Header `json:"header"`
+	LastCommit   *types.Commit `json:"last_commit"`
+	HasEvidence  bool          `json:"has_evidence,omitempty"`
+}
+
+// NewBlockRecord returns the compact record of a full block.
+func NewBlockRecord(block *types.Block) *BlockRecord {
+	return &BlockRecord{
+		Header:      block.Header,
+		LastCommit:  block.LastCommit,
+		HasEvidence: len(block.Evidence.Evidence) > 0,
+	}
+}
+
+// headerHasEvidence reports whether the block of header carries evidence.
+func headerHasEvidence(header *types.Header) bool {
+	return len(header.EvidenceHash) > 0 && !bytes.Equal(header.EvidenceHash, emptyEvidenceHash)
+}
+
+func BlockRecordToJSON(record *BlockRecord) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// BlockRecordFromJSON decodes a stored block, compact or full.
+func BlockRecordFromJSON(data []byte) (*BlockRecord, error) {
+	var stored struct {
+		BlockRecord
+		Evidence *struct {
+			Evidence []json.RawMessage `json:"evidence"`
+		} `json:"evidence"`
+	}
+
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal block record")
+	}
+
+	record := stored.BlockRecord
+	if stored.Evidence != nil && len(stored.Evidence.Evidence) > 0 {
+		record.HasEvidence = true
+	}
+
+	return &record, nil
+}
+
+// isFullBlock reports whether data holds a full block rather than a compact record.
+func isFullBlock(data []byte) (bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false, errors.Wrap(err, "failed to unmarshal block")
+	}
+
+	_, ok := fields["data"]
+	return ok, nil
+}
+
+// convertToHeaders rewrites every full block in the database as a compact
+// BlockRecord and returns how many blocks were converted.
+func convertToHeaders(db *Store) (int, error) {
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+
+	batch := new(Batch)
+	converted := 0
+
+	for iter.Next() {
+		_, kind, _, ok := parseHeightKey(iter.Key())
+		if !ok || kind != "block" {
+			continue
+		}
+
+		full, err := isFullBlock(iter.Value())
+		if err != nil {
+			return converted, errors.Wrapf(err, "failed to decode %s", iter.Key())
+		}
+		if !full {
+			continue
+		}
+
+		record, err := BlockRecordFromJSON(iter.Value())
+		if err != nil {
+			return converted, errors.Wrapf(err, "failed to decode %s", iter.Key())
+		}
+
+		data, err := BlockRecordToJSON(record)
+		if err != nil {
+			return converted, errors.Wrapf(err, "failed to encode %s", iter.Key())
+		}
+
+		batch.Put(iter.Key(), data)
+		converted++
+
+		if batch.Len() >= migrateBatchSize {
+			if err := db.Write(batch); err != nil {
+				return converted, errors.Wrap(err, "failed to write batch")
+			}
+			batch.Reset()
+			log.Infof("Converted %d blocks", converted)
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return converted, errors.Wrap(err, "failed to iterate database")
+	}
+
+	if err := db.Write(batch); err != nil {
+		return converted, errors.Wrap(err, "failed to write batch")
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+// latencySamples is how many recent RPC latencies are kept for percentiles.
+const latencySamples = 1024
+
+// ProgressReporter tracks the throughput, RPC latency and errors of one
+// indexing run or scan.
+type ProgressReporter struct {
+	name  string
+	unit  string
+	total uint64
+	start time.Time
+
+	done   uint64
+	errors uint64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// NewProgressReporter starts reporting progress of a task with total items.
+// Call Stop once the task is over.
+func NewProgressReporter(name, unit string, total uint64) *ProgressReporter {
+	r := &ProgressReporter{
+		name:  name,
+		unit:  unit,
+		total: total,
+		start: time.Now(),
+	}
+
+	renderer.add(r)
+
+	return r
+}
+
+// Add marks n items as processed.
+func (r *ProgressReporter) Add(n uint64) {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.done, n)
+}
+
+// Error marks one item as failed. Failed items also count as processed.
+func (r *ProgressReporter) Error() {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.errors, 1)
+	atomic.AddUint64(&r.done, 1)
+}
+
+// ObserveLatency records the duration of one RPC call.
+func (r *ProgressReporter) ObserveLatency(d time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.latencies) < latencySamples {
+		r.latencies = append(r.latencies, d)
+		return
+	}
+	r.latencies[r.next] = d
+	r.next = (r.next + 1) % latencySamples
+}
+
+// Stop removes the reporter and prints its final state.
+func (r *ProgressReporter) Stop() {
+	if r == nil {
+		return
+	}
+
+	renderer.remove(r)
+
+	s := r.snapshot()
+	log.Infof("%s: %d/%d %s in %s (%.1f %s/s), %d errors", s.name, s.done, s.total, r.unit, s.elapsed.Round(time.Second), s.rate, r.unit, s.errors)
+}
+
+type progressSnapshot struct {
+	name          string
+	done, total   uint64
+	errors        uint64
+	elapsed       time.Duration
+	rate          float64
+	eta           time.Duration
+	p50, p95, p99 time.Duration
+}
+
+func (r *ProgressReporter) snapshot() progressSnapshot {
+	s := progressSnapshot{
+		name:    r.name,
+		done:    atomic.LoadUint64(&r.done),
+		total:   r.total,
+		errors:  atomic.LoadUint64(&r.errors),
+		elapsed: time.Since(r.start),
+	}
+
+	if s.elapsed > 0 {
+		s.rate = float64(s.done) / s.elapsed.Seconds()
+	}
+	if s.rate > 0 && s.total > s.done {
+		s.eta = time.Duration(float64(s.total-s.done) / s.rate * float64(time.Second))
+	}
+
+	r.mu.Lock()
+	latencies := make([]time.Duration, len(r.latencies))
+	copy(latencies, r.latencies)
+	r.mu.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	s.p50 = percentile(latencies, 0.50)
+	s.p95 = percentile(latencies, 0.95)
+	s.p99 = percentile(latencies, 0.99)
+
+	return s
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// progressRenderer periodically draws every active reporter: as a single
+// progress bar line on a terminal, as structured log lines otherwise.
+type progressRenderer struct {
+	mu        sync.Mutex
+	reporters []*ProgressReporter
+	ticker    *time.Ticker
+	stop      chan struct{}
+	tty       bool
+	interval  time.Duration
+}
+
+var renderer = &progressRenderer{}
+
+func (p *progressRenderer) add(r *ProgressReporter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reporters = append(p.reporters, r)
+
+	if p.stop != nil {
+		return
+	}
+
+	p.tty = isatty.IsTerminal(os.Stderr.Fd())
+	p.interval = time.Second
+	if !p.tty && progressLogInterval > 0 {
+		p.interval = progressLogInterval
+	}
+
+	p.ticker = time.NewTicker(p.interval)
+	p.stop = make(chan struct{})
+	go p.run(p.ticker, p.stop)
+}
+
+func (p *progressRenderer) remove(r *ProgressReporter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, reporter := range p.reporters {
+		if reporter == r {
+			p.reporters = append(p.reporters[:i], p.reporters[i+1:]...)
+			break
+		}
+	}
+
+	if p.tty {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+
+	if len(p.reporters) == 0 && p.stop != nil {
+		p.ticker.Stop()
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+func (p *progressRenderer) run(ticker *time.Ticker, stop chan struct{}) {
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.draw()
+			p.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// draw must be called with p.mu held.
+func (p *progressRenderer) draw() {
+	if !p.tty {
+		for _, r := range p.reporters {
+			s := r.snapshot()
+			log.Logger().
+				With("task", s.name).
+				With("done", s.done).
+				With("total", s.total).
+				With("errors", s.errors).
+				With("rate", fmt.Sprintf("%.1f", s.rate)).
+				With("eta", s.eta.Round(time.Second).String()).
+				With("rpc_p50", s.p50.String()).
+				With("rpc_p95", s.p95.String()).
+				With("rpc_p99", s.p99.String()).
+				Infof("progress")
+		}
+		return
+	}
+
+	parts := []string{}
+	for _, r := range p.reporters {
+		parts = append(parts, r.bar())
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", strings.Join(parts, " | "))
+}
+
+func (r *ProgressReporter) bar() string {
+	const width = 20
+
+	s := r.snapshot()
+
+	filled := width
+	percent := 100.0
+	if s.total > 0 {
+		filled = int(s.done * width / s.total)
+		percent = float64(s.done) * 100 / float64(s.total)
+	}
+	if filled > width {
+		filled = width
+	}
+
+	line := fmt.Sprintf("%s [%s%s] %.1f%% %d/%d %.1f %s/s ETA %s",
+		s.name, strings.Repeat("=", filled), strings.Repeat(" ", width-filled), percent,
+		s.done, s.total, s.rate, r.unit, s.eta.Round(time.Second))
+
+	if s.p50 > 0 {
+		line += fmt.Sprintf(" rpc p50/p95/p99 %s/%s/%s", s.p50.Round(time.Millisecond), s.p95.Round(time.Millisecond), s.p99.Round(time.Millisecond))
+	}
+	if s.errors > 0 {
+		line += fmt.Sprintf(" errors %d", s.errors)
+	}
+
+	return line
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/config"
+	"github.com/starclusterteam/go-starbox/log"
+	rpctypes "github.com/tendermint/tendermint/rpc/jsonrpc/types"
+)
+
+// RetryConfig controls how RPC calls are retried.
+type RetryConfig struct {
+	// MaxAttempts is the number of times a call is tried before giving up.
+	MaxAttempts int
+	// Timeout is the deadline of a single attempt.
+	Timeout time.Duration
+	// MinBackoff is the wait after the first failed attempt, doubled on every retry.
+	MinBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts.
+	MaxBackoff time.Duration
+}
+
+func retryConfigFromEnv() (RetryConfig, error) {
+	cfg := RetryConfig{
+		MaxAttempts: config.Int("RPC_MAX_ATTEMPTS", 5),
+	}
+
+	var err error
+	if cfg.Timeout, err = config.Duration("RPC_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.MinBackoff, err = config.Duration("RPC_BACKOFF_MIN", 500*time.Millisecond); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBackoff, err = config.Duration("RPC_BACKOFF_MAX", 30*time.Second); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	return cfg, nil
+}
+
+// Backoff returns a randomized wait before the given retry, starting at 1.
+func (r RetryConfig) Backoff(retry int) time.Duration {
+	backoff := r.MinBackoff
+	for i := 1; i < retry && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	// equal jitter: anywhere between half and the whole backoff
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retry runs fn until it succeeds, returns a permanent error, runs out of
+// attempts or ctx is cancelled. Every attempt gets its own deadline.
+func (r RetryConfig) retry(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	var err error
+
+	for attempt := 1; attempt <= r.MaxAttempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, r.Timeout)
+		err = fn(attemptCtx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !isRetryable(err) || attempt == r.MaxAttempts {
+			break
+		}
+
+		backoff := r.Backoff(attempt)
+		log.Debugf("%s failed (attempt %d/%d), retrying in %s: %s", name, attempt, r.MaxAttempts, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// httpStatusError is returned for HTTP responses that carry no JSON-RPC result,
+// typically a gateway error from the proxy in front of the node.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %s", e.Status)
+}
+
+// statusCheckTransport turns 5xx responses into errors, so they are not
+// reported as JSON decoding failures.
+type statusCheckTransport struct {
+	next http.RoundTripper
+}
+
+func (t *statusCheckTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 500 {
+		resp.Body.Close()
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
+
+// isRetryable reports whether err is likely to go away on a later attempt:
+// timeouts, connection failures, 5xx responses and heights the node does
+// not have (yet).
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errNoHealthyEndpoint) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return true
+	}
+
+	var rpcErr *rpctypes.RPCError
+	if errors.As(err, &rpcErr) {
+		return isHeightNotAvailable(rpcErr)
+	}
+
+	return isHeightNotAvailable(err)
+}
+
+func isHeightNotAvailable(err error) bool {
+	msg := err.Error()
+	if rpcErr, ok := err.(*rpctypes.RPCError); ok {
+		msg = rpcErr.Message + " " + rpcErr.Data
+	}
+
+	return strings.Contains(msg, "is not available") ||
+		strings.Contains(msg, "must be less than or equal to the current blockchain height")
+}
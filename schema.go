@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+// schemaVersion is the current layout of the database.
+//
+// 1: heights formatted with %d, so keys do not sort by height
+// 2: heights zero-padded to 20 digits
+const schemaVersion = 2
+
+// migrateBatchSize is how many keys are rewritten per write batch.
+const migrateBatchSize = 10000
+
+var schemaVersionKey = []byte("meta:schema_version")
+
+// heightKinds are the key kinds that end in a block height.
+var heightKinds = []string{"block", "evidence", "validatorz", "failed"}
+
+// getSchemaVersion returns the schema version of the database. Databases
+// without a version key are version 1 unless they are empty.
+func getSchemaVersion(db *Store) (int, error) {
+	data, err := db.Get(schemaVersionKey)
+	if err == nil {
+		version, err := strconv.Atoi(string(data))
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid schema version %q", data)
+		}
+		return version, nil
+	}
+	if err != ErrNotFound {
+		return 0, errors.Wrap(err, "failed to get schema version")
+	}
+
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+
+	if iter.Next() {
+		return 1, nil
+	}
+
+	return schemaVersion, iter.Error()
+}
+
+func putSchemaVersion(db *Store, version int) error {
+	return db.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// checkSchema fails if the database needs a migration and stamps empty
+// databases with the current version, unless they are open read-only.
+func checkSchema(db *Store) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > schemaVersion {
+		return errors.Errorf("database schema version %d is newer than supported version %d", version, schemaVersion)
+	}
+
+	if version < schemaVersion {
+		return errors.Errorf("database schema version %d is outdated, run `vset-detect db migrate`", version)
+	}
+
+	if db.ReadOnly() {
+		return nil
+	}
+
+	stamped, err := db.Has(schemaVersionKey)
+	if err != nil || stamped {
+		return err
+	}
+
+	return putSchemaVersion(db, version)
+}
+
+// parseHeightKey splits a <chain>:<kind>:<height> key, for the kinds in heightKinds.
+func parseHeightKey(key []byte) (chain string, kind string, height uint64, ok bool) {
+	parts := bytes.Split(key, []byte(":"))
+	if len(parts) != 3 {
+		return "", "", 0, false
+	}
+
+	kind = string(parts[1])
+	known := false
+	for _, k := range heightKinds {
+		if k == kind {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return "", "", 0, false
+	}
+
+	height, err := strconv.ParseUint(string(parts[2]), 10, 64)
+	if err != nil {
+		return "", "", 0, false
+	}
+
+	return string(parts[0]), kind, height, true
+}
+
+// heightKey formats a <chain>:<kind>:<height> key with the height zero-padded,
+// so keys of one kind sort by height.
+func heightKey(chain string, kind string, height uint64) []byte {
+	key := fmt.Sprintf("%s:%s:%020d", chain, kind, height)
+	return []byte(key)
+}
+
+// migrateSchema rewrites the keys of a version 1 database to the current
+// layout, in place.
+func migrateSchema(db *Store) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version == schemaVersion {
+		log.Infof("Database is already at schema version %d", version)
+		return putSchemaVersion(db, version)
+	}
+
+	if version != 1 {
+		return errors.Errorf("don't know how to migrate schema version %d", version)
+	}
+
+	// the iterator reads from an implicit snapshot, so the rewritten keys are not visited again
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+
+	batch := new(Batch)
+	migrated := 0
+
+	for iter.Next() {
+		chain, kind, height, ok := parseHeightKey(iter.Key())
+		if !ok {
+			continue
+		}
+
+		newKey := heightKey(chain, kind, height)
+		if bytes.Equal(newKey, iter.Key()) {
+			continue
+		}
+
+		batch.Put(newKey, iter.Value())
+		batch.Delete(iter.Key())
+		migrated++
+
+		if batch.Len() >= migrateBatchSize*2 {
+			if err := db.Write(batch); err != nil {
+				return errors.Wrap(err, "failed to write batch")
+			}
+			batch.Reset()
+			log.Infof("Migrated %d keys", migrated)
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return errors.Wrap(err, "failed to iterate database")
+	}
+
+	if err := db.Write(batch); err != nil {
+		return errors.Wrap(err, "failed to write batch")
+	}
+
+	log.Infof("Migrated %d keys to schema version %d", migrated, schemaVersion)
+
+	return putSchemaVersion(db, schemaVersion)
+}
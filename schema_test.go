@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHeightKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		chain  string
+		kind   string
+		height uint64
+		ok     bool
+	}{
+		{"provider:block:00000000000000000042", "provider", "block", 42, true},
+		{"gopher:validatorz:7", "gopher", "validatorz", 7, true},
+		{"gopher:evidence:00000000000000000001", "gopher", "evidence", 1, true},
+		{"gopher:failed:18446744073709551615", "gopher", "failed", 18446744073709551615, true},
+		{"gopher:progress", "", "", 0, false},
+		{"gopher:unknown:1", "", "", 0, false},
+		{"gopher:block:abc", "", "", 0, false},
+		{"gopher:block:-1", "", "", 0, false},
+		{"meta:schema_version", "", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			chain, kind, height, ok := parseHeightKey([]byte(tt.key))
+			if chain != tt.chain || kind != tt.kind || height != tt.height || ok != tt.ok {
+				t.Errorf("got %q %q %d %t, want %q %q %d %t", chain, kind, height, ok, tt.chain, tt.kind, tt.height, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHeightKeySortsByHeight(t *testing.T) {
+	if string(heightKey("gopher", "block", 9)) >= string(heightKey("gopher", "block", 10)) {
+		t.Errorf("key of height 9 sorts after key of height 10")
+	}
+
+	chain, kind, height, ok := parseHeightKey(heightKey("gopher", "block", 10))
+	if !ok || chain != "gopher" || kind != "block" || height != 10 {
+		t.Errorf("got %q %q %d %t, want gopher block 10", chain, kind, height, ok)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	db := newTestStore(t)
+
+	// a version 1 database: unpadded heights and no version key
+	v1 := map[string]string{
+		"provider:block:9":      "block 9",
+		"provider:block:10":     "block 10",
+		"provider:validatorz:9": "validators 9",
+		"provider:progress":     "progress",
+	}
+	for key, value := range v1 {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := checkSchema(db); err == nil {
+		t.Fatal("checkSchema accepted a version 1 database")
+	}
+
+	if err := migrateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		string(heightKey("provider", "block", 9)):      "block 9",
+		string(heightKey("provider", "block", 10)):     "block 10",
+		string(heightKey("provider", "validatorz", 9)): "validators 9",
+		"provider:progress":                            "progress",
+		string(schemaVersionKey):                       "2",
+	}
+
+	got := map[string]string{}
+	iter := db.NewIterator(nil)
+	for iter.Next() {
+		got[string(iter.Key())] = string(iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("got %d keys, want %d: %v", len(got), len(want), got)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s is %q, want %q", key, got[key], value)
+		}
+	}
+
+	if err := checkSchema(db); err != nil {
+		t.Errorf("checkSchema after migration: %s", err)
+	}
+
+	// migrating again is a no-op
+	if err := migrateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+// snapshotAttempts is how many times a snapshot is retried when the database
+// changes while it is being copied.
+const snapshotAttempts = 3
+
+// snapshotBackend is a private copy of a database directory, removed on Close.
+type snapshotBackend struct {
+	Backend
+	dir string
+}
+
+func (s *snapshotBackend) Close() error {
+	err := s.Backend.Close()
+	if rmErr := os.RemoveAll(s.dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// openSnapshot copies the LevelDB or Pebble directory at path, which another
+// process may be writing to, and opens the copy with open.
+func openSnapshot(path string, open func(dir string) (Backend, error)) (Backend, error) {
+	var err error
+
+	for attempt := 1; attempt <= snapshotAttempts; attempt++ {
+		var dir string
+		dir, err = snapshotDir(path)
+		if err == nil {
+			var b Backend
+			b, err = open(dir)
+			if err == nil {
+				log.Infof("Reading from snapshot %s of %s", dir, path)
+				return &snapshotBackend{Backend: b, dir: dir}, nil
+			}
+		}
+
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+		log.Debugf("Snapshot attempt %d of %s failed: %s", attempt, path, err)
+	}
+
+	return nil, errors.Wrap(err, "failed to snapshot database")
+}
+
+// snapshotDir makes a point-in-time copy of a database directory next to it.
+// The manifest and logs are copied before the table files, so every table the
+// copied manifest references is still there; tables are immutable and hard
+// linked when the filesystem allows it. A table compacted away in the
+// meantime fails the snapshot, which is then retried.
+func snapshotDir(path string) (string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+
+	isTable := func(name string) bool {
+		return strings.HasSuffix(name, ".ldb") || strings.HasSuffix(name, ".sst")
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return !isTable(entries[i].Name()) && isTable(entries[j].Name())
+	})
+
+	clean := filepath.Clean(path)
+	dir, err := os.MkdirTemp(filepath.Dir(clean), filepath.Base(clean)+".snapshot-*")
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == "LOCK" || strings.HasPrefix(name, "LOG") {
+			continue
+		}
+
+		src := filepath.Join(path, name)
+		dst := filepath.Join(dir, name)
+
+		if isTable(name) && os.Link(src, dst) == nil {
+			continue
+		}
+
+		if err := copyFile(src, dst); err != nil {
+			return dir, err
+		}
+	}
+
+	return dir, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
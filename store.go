@@ -0,0 +1,203 @@
+package main
+
+import (
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by Backend.Get for missing keys.
+var ErrNotFound = errors.New("not found")
+
+var errReadOnly = errors.New("database is open read-only")
+
+// Backend is an ordered key-value database.
+type Backend interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Write applies the batch atomically.
+	Write(batch *Batch) error
+	// NewIterator returns the keys in r in ascending order, or every key if r is nil.
+	NewIterator(r *KeyRange) Iterator
+	// Compact reclaims the space of deleted and overwritten keys.
+	Compact() error
+	Close() error
+}
+
+// Iterator walks a range of keys. Key and Value are only valid until the next call to Next.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+// KeyRange holds the keys from Start up to, but not including, Limit. A nil
+// Limit means no upper bound.
+type KeyRange struct {
+	Start []byte
+	Limit []byte
+}
+
+// PrefixRange returns the range of keys starting with prefix.
+func PrefixRange(prefix []byte) *KeyRange {
+	var limit []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			limit = make([]byte, i+1)
+			copy(limit, prefix)
+			limit[i]++
+			break
+		}
+	}
+
+	return &KeyRange{Start: prefix, Limit: limit}
+}
+
+// Batch collects writes to apply at once.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte{}, key...), delete: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Store holds the blocks, evidence, validator sets and progress of every chain.
+type Store struct {
+	Backend
+	readOnly bool
+}
+
+// openStore opens the database at path with the named backend: leveldb,
+// pebble or sqlite. A read-only store never takes the write lock, so it can
+// be opened while an indexer is running; when the backend can't share the
+// database it reads from a snapshot instead.
+func openStore(backend string, path string, readOnly bool) (*Store, error) {
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, errors.Wrap(err, "failed to open database")
+		}
+	}
+
+	var b Backend
+	var err error
+
+	switch backend {
+	case "", "leveldb":
+		b, err = openLevelDB(path, readOnly)
+	case "pebble":
+		b, err = openPebble(path, readOnly)
+	case "sqlite":
+		b, err = openSQLite(path, readOnly)
+	default:
+		return nil, errors.Errorf("unknown database backend %q", backend)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s database", backend)
+	}
+
+	if readOnly {
+		b = readOnlyBackend{b}
+	}
+
+	return &Store{Backend: b, readOnly: readOnly}, nil
+}
+
+func (s *Store) ReadOnly() bool {
+	return s.readOnly
+}
+
+// readOnlyBackend rejects every write.
+type readOnlyBackend struct {
+	Backend
+}
+
+func (readOnlyBackend) Put(key, value []byte) error {
+	return errReadOnly
+}
+
+func (readOnlyBackend) Delete(key []byte) error {
+	return errReadOnly
+}
+
+func (readOnlyBackend) Write(batch *Batch) error {
+	return errReadOnly
+}
+
+func (readOnlyBackend) Compact() error {
+	return errReadOnly
+}
+
+func (s *Store) Block(chain string, height uint64) ([]byte, error) {
+	return s.Get(BlockKey(chain, height))
+}
+
+func (s *Store) HasBlock(chain string, height uint64) (bool, error) {
+	return s.Has(BlockKey(chain, height))
+}
+
+func (s *Store) PutBlock(chain string, height uint64, data []byte) error {
+	return s.Put(BlockKey(chain, height), data)
+}
+
+// Blocks iterates the stored blocks of a chain from one height up to and including another.
+func (s *Store) Blocks(chain string, from, to uint64) Iterator {
+	return s.Heights(chain, "block", from, to)
+}
+
+// Heights iterates the keys of one kind of a chain from one height up to and
+// including another.
+func (s *Store) Heights(chain string, kind string, from, to uint64) Iterator {
+	r := PrefixRange([]byte(chain + ":" + kind + ":"))
+	r.Start = heightKey(chain, kind, from)
+	if to < math.MaxUint64 {
+		r.Limit = heightKey(chain, kind, to+1)
+	}
+
+	return s.NewIterator(r)
+}
+
+func (s *Store) Evidence(chain string, height uint64) ([]byte, error) {
+	return s.Get(EvidenceKey(chain, height))
+}
+
+func (s *Store) PutEvidence(chain string, height uint64, data []byte) error {
+	return s.Put(EvidenceKey(chain, height), data)
+}
+
+// AllEvidence iterates the stored evidence of a chain by height.
+func (s *Store) AllEvidence(chain string) Iterator {
+	return s.NewIterator(PrefixRange([]byte(chain + ":evidence:")))
+}
+
+func (s *Store) Validators(chain string, height uint64) ([]byte, error) {
+	return s.Get(ValidatorsKey(chain, height))
+}
+
+func (s *Store) PutValidators(chain string, height uint64, data []byte) error {
+	return s.Put(ValidatorsKey(chain, height), data)
+}
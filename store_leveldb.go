@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/starclusterteam/go-starbox/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelDB is the default Backend, a goleveldb directory.
+type levelDB struct {
+	db *leveldb.DB
+}
+
+// openLevelDB opens a LevelDB directory. A read-only open still needs the
+// directory lock, so while another process holds it the database is read
+// from a snapshot.
+func openLevelDB(path string, readOnly bool) (Backend, error) {
+	db, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: readOnly})
+	if err == nil {
+		return &levelDB{db: db}, nil
+	}
+	if !readOnly {
+		return nil, err
+	}
+
+	log.Warningf("Failed to open %s read-only, falling back to a snapshot: %s", path, err)
+
+	return openSnapshot(path, func(dir string) (Backend, error) {
+		db, err := leveldb.OpenFile(dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &levelDB{db: db}, nil
+	})
+}
+
+func (l *levelDB) Get(key []byte) ([]byte, error) {
+	value, err := l.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (l *levelDB) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+func (l *levelDB) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *levelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *levelDB) Write(batch *Batch) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+
+	return l.db.Write(b, nil)
+}
+
+func (l *levelDB) NewIterator(r *KeyRange) Iterator {
+	var slice *util.Range
+	if r != nil {
+		slice = &util.Range{Start: r.Start, Limit: r.Limit}
+	}
+
+	return l.db.NewIterator(slice, nil)
+}
+
+func (l *levelDB) Compact() error {
+	return l.db.CompactRange(util.Range{})
+}
+
+func (l *levelDB) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/starclusterteam/go-starbox/log"
+)
+
+// pebbleDB is a Backend on a Pebble directory.
+type pebbleDB struct {
+	db *pebble.DB
+}
+
+// openPebble opens a Pebble directory. Like LevelDB, Pebble locks the
+// directory even when read-only, so while another process holds it the
+// database is read from a snapshot.
+func openPebble(path string, readOnly bool) (Backend, error) {
+	db, err := pebble.Open(path, &pebble.Options{ReadOnly: readOnly, Logger: pebbleLogger{}})
+	if err == nil {
+		return &pebbleDB{db: db}, nil
+	}
+	if !readOnly {
+		return nil, err
+	}
+
+	log.Warningf("Failed to open %s read-only, falling back to a snapshot: %s", path, err)
+
+	return openSnapshot(path, func(dir string) (Backend, error) {
+		db, err := pebble.Open(dir, &pebble.Options{ReadOnly: true, Logger: pebbleLogger{}})
+		if err != nil {
+			return nil, err
+		}
+		return &pebbleDB{db: db}, nil
+	})
+}
+
+func (p *pebbleDB) Get(key []byte) ([]byte, error) {
+	value, closer, err := p.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	// value is only valid until the closer is closed
+	return append([]byte{}, value...), nil
+}
+
+func (p *pebbleDB) Has(key []byte) (bool, error) {
+	_, err := p.Get(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p *pebbleDB) Put(key, value []byte) error {
+	return p.db.Set(key, value, pebble.Sync)
+}
+
+func (p *pebbleDB) Delete(key []byte) error {
+	return p.db.Delete(key, pebble.Sync)
+}
+
+func (p *pebbleDB) Write(batch *Batch) error {
+	b := p.db.NewBatch()
+	defer b.Close()
+
+	for _, op := range batch.ops {
+		var err error
+		if op.delete {
+			err = b.Delete(op.key, nil)
+		} else {
+			err = b.Set(op.key, op.value, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Commit(pebble.Sync)
+}
+
+func (p *pebbleDB) NewIterator(r *KeyRange) Iterator {
+	opts := &pebble.IterOptions{}
+	if r != nil {
+		opts.LowerBound = r.Start
+		opts.UpperBound = r.Limit
+	}
+
+	iter, err := p.db.NewIter(opts)
+	return &pebbleIterator{iter: iter, err: err}
+}
+
+// Compact compacts the whole key space, from the first key to the last.
+func (p *pebbleDB) Compact() error {
+	iter, err := p.db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+
+	if !iter.First() {
+		return iter.Close()
+	}
+	start := append([]byte{}, iter.Key()...)
+	iter.Last()
+	end := append(append([]byte{}, iter.Key()...), 0)
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	return p.db.Compact(start, end, true)
+}
+
+func (p *pebbleDB) Close() error {
+	return p.db.Close()
+}
+
+// pebbleLogger sends Pebble's informational messages to the debug log.
+type pebbleLogger struct{}
+
+func (pebbleLogger) Infof(format string, args ...interface{}) {
+	log.Debugf(format, args...)
+}
+
+func (pebbleLogger) Fatalf(format string, args ...interface{}) {
+	log.Fatalf(format, args...)
+}
+
+// pebbleIterator adapts a Pebble iterator, which must be positioned with
+// First before the first Next.
+type pebbleIterator struct {
+	iter    *pebble.Iterator
+	err     error
+	started bool
+}
+
+func (i *pebbleIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+
+	if !i.started {
+		i.started = true
+		return i.iter.First()
+	}
+
+	return i.iter.Next()
+}
+
+func (i *pebbleIterator) Key() []byte {
+	return i.iter.Key()
+}
+
+func (i *pebbleIterator) Value() []byte {
+	return i.iter.Value()
+}
+
+func (i *pebbleIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+func (i *pebbleIterator) Release() {
+	if i.iter != nil {
+		i.iter.Close()
+	}
+}
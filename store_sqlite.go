@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBusyTimeout is how long a write waits for another writer, in milliseconds.
+const sqliteBusyTimeout = 10000
+
+// sqliteDB is a Backend on a single SQLite file in WAL mode, so readers do
+// not block the indexer.
+type sqliteDB struct {
+	db *sql.DB
+}
+
+// openSQLite opens a SQLite file. Read-only connections share the file with
+// a running indexer and see the last committed write.
+func openSQLite(path string, readOnly bool) (Backend, error) {
+	params := url.Values{}
+	if readOnly {
+		params.Add("mode", "ro")
+		params.Add("_pragma", "query_only(1)")
+	} else {
+		params.Add("_pragma", "journal_mode(WAL)")
+		params.Add("_pragma", "synchronous(NORMAL)")
+	}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout))
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	if readOnly {
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &sqliteDB{db: db}, nil
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (key BLOB PRIMARY KEY, value BLOB NOT NULL) WITHOUT ROWID`)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to create table")
+	}
+
+	return &sqliteDB{db: db}, nil
+}
+
+func (s *sqliteDB) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *sqliteDB) Has(key []byte) (bool, error) {
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM kv WHERE key = ?`, key).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqliteDB) Put(key, value []byte) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+func (s *sqliteDB) Delete(key []byte) error {
+	_, err := s.db.Exec(`DELETE FROM kv WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteDB) Write(batch *Batch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, op := range batch.ops {
+		if op.delete {
+			_, err = tx.Exec(`DELETE FROM kv WHERE key = ?`, op.key)
+		} else {
+			_, err = tx.Exec(`INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)`, op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteDB) NewIterator(r *KeyRange) Iterator {
+	query := `SELECT key, value FROM kv`
+	args := []interface{}{}
+
+	switch {
+	case r != nil && r.Limit != nil:
+		query += ` WHERE key >= ? AND key < ?`
+		args = append(args, r.Start, r.Limit)
+	case r != nil:
+		query += ` WHERE key >= ?`
+		args = append(args, r.Start)
+	}
+	query += ` ORDER BY key`
+
+	rows, err := s.db.Query(query, args...)
+	return &sqliteIterator{rows: rows, err: err}
+}
+
+// Compact checkpoints the write-ahead log and rebuilds the file.
+func (s *sqliteDB) Compact() error {
+	if _, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+func (s *sqliteDB) Close() error {
+	return s.db.Close()
+}
+
+type sqliteIterator struct {
+	rows  *sql.Rows
+	err   error
+	key   []byte
+	value []byte
+}
+
+func (i *sqliteIterator) Next() bool {
+	if i.err != nil || !i.rows.Next() {
+		return false
+	}
+
+	i.key, i.value = nil, nil
+	if err := i.rows.Scan(&i.key, &i.value); err != nil {
+		i.err = err
+		return false
+	}
+
+	return true
+}
+
+func (i *sqliteIterator) Key() []byte {
+	return i.key
+}
+
+func (i *sqliteIterator) Value() []byte {
+	return i.value
+}
+
+func (i *sqliteIterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.rows.Err()
+}
+
+func (i *sqliteIterator) Release() {
+	if i.rows != nil {
+		i.rows.Close()
+	}
+}
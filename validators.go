@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	tmjson "github.com/tendermint/tendermint/libs/json"
+	"github.com/tendermint/tendermint/types"
+)
+
+// Header fields a validator set hash is checked against.
+const (
+	fieldValidatorsHash     = "validators_hash"
+	fieldNextValidatorsHash = "next_validators_hash"
+)
+
+// ValsetMismatch is a validator set whose recomputed hash differs from the
+// hash committed in a header: the ValidatorsHash of the block at Height, or
+// the NextValidatorsHash of the block before it.
+type ValsetMismatch struct {
+	Chain    string `json:"chain"`
+	Height   uint64 `json:"height"`
+	Field    string `json:"field"`
+	Header   []byte `json:"header"`
+	Computed []byte `json:"computed"`
+}
+
+func (m ValsetMismatch) String() string {
+	height := m.Height
+	if m.Field == fieldNextValidatorsHash {
+		height--
+	}
+	return fmt.Sprintf("%s: validator set at %d hashes to %X, %s of block %d is %X", m.Chain, m.Height, m.Computed, m.Field, height, m.Header)
+}
+
+// ValidatorsToJSON encodes validators with their public keys.
+func ValidatorsToJSON(validators []*types.Validator) ([]byte, error) {
+	return tmjson.Marshal(validators)
+}
+
+// ValidatorsFromJSON decodes cached validators. Sets cached before public
+// keys were kept are plain JSON and decode without them.
+func ValidatorsFromJSON(data []byte) ([]*types.Validator, error) {
+	var validators []*types.Validator
+
+	err := tmjson.Unmarshal(data, &validators)
+	if err == nil {
+		return validators, nil
+	}
+
+	if legacyErr := json.Unmarshal(data, &validators); legacyErr != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal validators")
+	}
+
+	return validators, nil
+}
+
+// hasPubKeys reports whether the hash of validators can be recomputed.
+func hasPubKeys(validators []*types.Validator) bool {
+	for _, v := range validators {
+		if v.PubKey == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// checkValsetHash recomputes the hash of the validators at header's height
+// and compares it with the header's ValidatorsHash and, if prev is the block
+// before, its NextValidatorsHash.
+func checkValsetHash(chain string, validators []*types.Validator, header, prev *types.Header) []ValsetMismatch {
+	computed := (&types.ValidatorSet{Validators: validators}).Hash()
+	height := uint64(header.Height)
+
+	mismatches := []ValsetMismatch{}
+
+	if !bytes.Equal(computed, header.ValidatorsHash) {
+		mismatches = append(mismatches, ValsetMismatch{
+			Chain:    chain,
+			Height:   height,
+			Field:    fieldValidatorsHash,
+			Header:   header.ValidatorsHash,
+			Computed: computed,
+		})
+	}
+
+	if prev != nil && prev.Height == header.Height-1 && !bytes.Equal(computed, prev.NextValidatorsHash) {
+		mismatches = append(mismatches, ValsetMismatch{
+			Chain:    chain,
+			Height:   height,
+			Field:    fieldNextValidatorsHash,
+			Header:   prev.NextValidatorsHash,
+			Computed: computed,
+		})
+	}
+
+	return mismatches
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tendermint/tendermint/types"
+)
+
+// ValidatorPower is one member of a validator set.
+type ValidatorPower struct {
+	Address string `json:"address"`
+	Power   int64  `json:"power"`
+}
+
+// ValidatorSet is a validator set reduced to what a consumer chain mirrors
+// from the provider: addresses and voting powers, sorted by address.
+type ValidatorSet []ValidatorPower
+
+func NewValidatorSet(validators []*types.Validator) ValidatorSet {
+	set := make(ValidatorSet, 0, len(validators))
+	for _, v := range validators {
+		set = append(set, ValidatorPower{Address: v.Address.String(), Power: v.VotingPower})
+	}
+
+	sort.Slice(set, func(i, j int) bool {
+		return set[i].Address < set[j].Address
+	})
+
+	return set
+}
+
+// Hash identifies the set: the hex SHA-256 of its address:power pairs in
+// address order. Unlike the Tendermint hash it leaves out public keys, so a
+// provider and a consumer set compare equal with different consensus keys.
+func (s ValidatorSet) Hash() string {
+	pairs := make([]string, 0, len(s))
+	for _, v := range s {
+		pairs = append(pairs, fmt.Sprintf("%s:%d", v.Address, v.Power))
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(pairs, ";"))))
+}
+
+// TotalPower returns the sum of the voting powers.
+func (s ValidatorSet) TotalPower() int64 {
+	var total int64
+	for _, v := range s {
+		total += v.Power
+	}
+	return total
+}
+
+// PowerChange is a validator whose voting power differs between two sets.
+type PowerChange struct {
+	Address  string `json:"address"`
+	OldPower int64  `json:"old_power"`
+	NewPower int64  `json:"new_power"`
+}
+
+// ValsetDiff lists how one validator set differs from another.
+type ValsetDiff struct {
+	Added   []ValidatorPower `json:"added,omitempty"`
+	Removed []ValidatorPower `json:"removed,omitempty"`
+	Changed []PowerChange    `json:"changed,omitempty"`
+}
+
+// Diff returns the changes that turn s into other.
+func (s ValidatorSet) Diff(other ValidatorSet) ValsetDiff {
+	diff := ValsetDiff{}
+
+	i, j := 0, 0
+	for i < len(s) || j < len(other) {
+		switch {
+		case j == len(other) || (i < len(s) && s[i].Address < other[j].Address):
+			diff.Removed = append(diff.Removed, s[i])
+			i++
+		case i == len(s) || other[j].Address < s[i].Address:
+			diff.Added = append(diff.Added, other[j])
+			j++
+		default:
+			if s[i].Power != other[j].Power {
+				diff.Changed = append(diff.Changed, PowerChange{Address: s[i].Address, OldPower: s[i].Power, NewPower: other[j].Power})
+			}
+			i++
+			j++
+		}
+	}
+
+	return diff
+}
+
+func (d ValsetDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d ValsetDiff) String() string {
+	if d.Empty() {
+		return "no differences"
+	}
+
+	lines := []string{}
+	for _, v := range d.Added {
+		lines = append(lines, fmt.Sprintf("+ %s %d", v.Address, v.Power))
+	}
+	for _, v := range d.Removed {
+		lines = append(lines, fmt.Sprintf("- %s %d", v.Address, v.Power))
+	}
+	for _, c := range d.Changed {
+		lines = append(lines, fmt.Sprintf("~ %s %d -> %d", c.Address, c.OldPower, c.NewPower))
+	}
+
+	return strings.Join(lines, "\n")
+}
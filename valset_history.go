@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+	"github.com/tendermint/tendermint/types"
+)
+
+// valsetFlushInterval is how many blocks are walked between writes of the
+// validator set history.
+const valsetFlushInterval = 10000
+
+// ValsetRecord is a stored validator set change. Sets are stored with the
+// chain's own addresses; key assignment is applied when they are loaded.
+type ValsetRecord struct {
+	ValsetUpdate
+	// Mismatches are the header hashes the set did not match when it was recorded.
+	Mismatches []ValsetMismatch `json:"mismatches,omitempty"`
+}
+
+// ValsetCursor records how far the validator set history of a chain reaches:
+// every change between From and Height is stored.
+type ValsetCursor struct {
+	MinHeight uint64 `json:"min_height"`
+	// From is the first height of the history, above MinHeight when the
+	// blocks before it are pruned or not indexed. Zero means MinHeight.
+	From   uint64 `json:"from,omitempty"`
+	Height uint64 `json:"height"`
+}
+
+// Start returns the first height of the history.
+func (c *ValsetCursor) Start() uint64 {
+	if c.From == 0 {
+		return c.MinHeight
+	}
+	return c.From
+}
+
+func ValsetKey(chain string, height uint64) []byte {
+	return heightKey(chain, "valset", height)
+}
+
+func ValsetCursorKey(chain string) []byte {
+	key := fmt.Sprintf("%s:valset-cursor", chain)
+	return []byte(key)
+}
+
+// ValsetCursor returns the stored cursor of a chain, or nil if it has no history.
+func (s *Store) ValsetCursor(chain string) (*ValsetCursor, error) {
+	data, err := s.Get(ValsetCursorKey(chain))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get validator set cursor")
+	}
+
+	cursor := &ValsetCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, errors.Wrap(err, "failed to decode validator set cursor")
+	}
+
+	return cursor, nil
+}
+
+// ValsetHistory returns the stored validator set changes of a chain between
+// the heights from and to.
+func (s *Store) ValsetHistory(chain string, from, to uint64) ([]ValsetRecord, error) {
+	iter := s.Heights(chain, "valset", from, to)
+	defer iter.Release()
+
+	records := []ValsetRecord{}
+	for iter.Next() {
+		record := ValsetRecord{}
+		if err := json.Unmarshal(iter.Value(), &record); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", iter.Key())
+		}
+		records = append(records, record)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate validator set history")
+	}
+
+	return records, nil
+}
+
+// ValsetHistoryBetween returns the stored validator set changes of a chain
+// made between since and until, inclusive. Zero times are not checked.
+func (s *Store) ValsetHistoryBetween(chain string, since, until time.Time) ([]ValsetRecord, error) {
+	records, err := s.ValsetHistory(chain, 0, math.MaxUint64)
+	if err != nil {
+		return nil, err
+	}
+
+	between := []ValsetRecord{}
+	for _, record := range records {
+		if !since.IsZero() && record.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && record.Timestamp.After(until) {
+			break
+		}
+		between = append(between, record)
+	}
+
+	return between, nil
+}
+
+// TruncateValsetHistory drops the stored validator set changes from height
+// on, so they are computed again from the blocks.
+func (s *Store) TruncateValsetHistory(chain string, height uint64) error {
+	cursor, err := s.ValsetCursor(chain)
+	if err != nil || cursor == nil || cursor.Height < height {
+		return err
+	}
+
+	batch := new(Batch)
+
+	iter := s.Heights(chain, "valset", height, math.MaxUint64)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return errors.Wrap(err, "failed to iterate validator set history")
+	}
+
+	if height <= cursor.Start() {
+		batch.Delete(ValsetCursorKey(chain))
+	} else {
+		cursor.Height = height - 1
+		data, err := json.Marshal(cursor)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode validator set cursor")
+		}
+		batch.Put(ValsetCursorKey(chain), data)
+	}
+
+	return s.Write(batch)
+}
+
+// updateValsetHistory returns the validator set changes of a chain from its
+// first indexed height up to to. The stored history is extended with the
+// contiguous blocks indexed after it, walking them and fetching the validator sets at
+// the heights where the ValidatorsHash changes. The extension is saved unless
+// the database is read-only. It also returns the height the history reaches,
+// which is below to when a block after it is not indexed.
+func updateValsetHistory(ctx context.Context, db *Store, rpc *RPCClient, chain *ChainConfig, to uint64) ([]ValsetRecord, uint64, error) {
+	cursor, err := db.ValsetCursor(chain.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	progress, err := db.Progress(chain.Name)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to load progress")
+	}
+
+	// the history starts at the first indexed block, the ones before it may
+	// be pruned on every endpoint
+	from := chain.MinHeight
+	if covered := progress.Covered(); len(covered) > 0 && covered[0].From > from {
+		from = covered[0].From
+
+		skipped := subtractRanges([]HeightRange{{From: chain.MinHeight, To: from - 1}}, progress.Unavailable)
+		if len(skipped) > 0 {
+			log.Warningf("Blocks %s of %s are not indexed, its validator set history starts at %d", skipped[0], chain.Name, from)
+		}
+	}
+
+	if cursor != nil && (cursor.MinHeight != chain.MinHeight || cursor.Start() > from) {
+		log.Infof("Validator set history of %s started at %d, computing it again from %d", chain.Name, cursor.Start(), from)
+		if !db.ReadOnly() {
+			if err := db.TruncateValsetHistory(chain.Name, 0); err != nil {
+				return nil, 0, errors.Wrap(err, "failed to reset validator set history")
+			}
+		}
+		cursor = nil
+	}
+
+	if cursor == nil {
+		cursor = &ValsetCursor{MinHeight: chain.MinHeight, From: from, Height: from - 1}
+	}
+
+	end := cursor.Height
+	if to < end {
+		end = to
+	}
+
+	from = cursor.Start()
+
+	records := []ValsetRecord{}
+	if end >= from {
+		records, err = db.ValsetHistory(chain.Name, from, end)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if to <= cursor.Height {
+		return records, to, nil
+	}
+
+	var prev *BlockRecord
+	if cursor.Height >= from {
+		data, err := db.Block(chain.Name, cursor.Height)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "failed to get block %d", cursor.Height)
+		}
+		prev, err = BlockRecordFromJSON(data)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "failed to decode block %d", cursor.Height)
+		}
+	}
+
+	lastValidatorHash := ""
+	lastSetHash := ""
+	if len(records) > 0 {
+		lastValidatorHash = records[len(records)-1].ValidatorsHash
+		lastSetHash = records[len(records)-1].SetHash
+	}
+
+	reporter := NewProgressReporter("scan "+chain.Name, "blocks", to-cursor.Height)
+	defer reporter.Stop()
+	rpc.SetReporter(reporter)
+	defer rpc.SetReporter(nil)
+
+	batch := new(Batch)
+	flush := func() error {
+		if db.ReadOnly() {
+			return nil
+		}
+
+		data, err := json.Marshal(cursor)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode validator set cursor")
+		}
+		batch.Put(ValsetCursorKey(chain.Name), data)
+
+		if err := db.Write(batch); err != nil {
+			return errors.Wrap(err, "failed to save validator set history")
+		}
+		batch.Reset()
+		return nil
+	}
+
+	iter := db.Blocks(chain.Name, cursor.Height+1, to)
+	defer iter.Release()
+
+	expectedHeight := cursor.Height + 1
+
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		// stop at the first height that is not indexed
+		_, _, height, ok := parseHeightKey(iter.Key())
+		if !ok || height != expectedHeight {
+			break
+		}
+		expectedHeight++
+
+		reporter.Add(1)
+
+		block, err := BlockRecordFromJSON(iter.Value())
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "failed to parse block: %s", iter.Key())
+		}
+
+		var prevHeader *types.Header
+		if prev != nil {
+			prevHeader = &prev.Header
+		}
+		prev = block
+
+		validatorsHash := block.ValidatorsHash.String()
+
+		if validatorsHash != lastValidatorHash {
+			log.Debugf("Found new validator set: %s at height %d", validatorsHash, block.Height)
+
+			valsetlist, err := rpc.GetValidatorsAtHeight(ctx, block.Height)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "failed to get validator set at height %d", block.Height)
+			}
+			set := NewValidatorSet(valsetlist)
+			setHash := set.Hash()
+
+			record := ValsetRecord{
+				ValsetUpdate: ValsetUpdate{
+					Height:            block.Height,
+					Timestamp:         block.Time,
+					ValidatorsHash:    validatorsHash,
+					OldValidatorsHash: lastValidatorHash,
+					SetHash:           setHash,
+					OldSetHash:        lastSetHash,
+					Validators:        set,
+				},
+			}
+
+			if hasPubKeys(valsetlist) {
+				for _, mismatch := range checkValsetHash(chain.Name, valsetlist, &block.Header, prevHeader) {
+					log.Warningf("Validator set hash mismatch: %s", mismatch)
+					record.Mismatches = append(record.Mismatches, mismatch)
+				}
+			}
+
+			data, err := json.Marshal(record)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "failed to encode validator set change")
+			}
+			batch.Put(ValsetKey(chain.Name, height), data)
+
+			records = append(records, record)
+
+			lastValidatorHash = validatorsHash
+			lastSetHash = setHash
+		}
+
+		cursor.Height = height
+		if (height-from)%valsetFlushInterval == 0 {
+			if err := flush(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to iterate blocks")
+	}
+
+	if err := flush(); err != nil {
+		return nil, 0, err
+	}
+
+	return records, cursor.Height, nil
+}
+
+// valsetHistoryUpdates returns the changes of records and the hash
+// mismatches found when they were recorded.
+func valsetHistoryUpdates(records []ValsetRecord) ([]ValsetUpdate, []ValsetMismatch) {
+	updates := make([]ValsetUpdate, 0, len(records))
+	mismatches := []ValsetMismatch{}
+
+	for _, record := range records {
+		updates = append(updates, record.ValsetUpdate)
+		mismatches = append(mismatches, record.Mismatches...)
+	}
+
+	return updates, mismatches
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/types"
+)
+
+var testGenesis = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	db, err := openStore("leveldb", filepath.Join(t.TempDir(), "db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func testValidators(powers ...int64) []*types.Validator {
+	validators := []*types.Validator{}
+	for i, power := range powers {
+		key := ed25519.GenPrivKeyFromSecret([]byte{byte(i)}).PubKey()
+		validators = append(validators, types.NewValidator(key, power))
+	}
+	return validators
+}
+
+// storeTestBlocks stores the blocks from from to to and their validator sets.
+// sets[height] takes effect at height and stays until the next one.
+func storeTestBlocks(t *testing.T, db *Store, chain string, from, to uint64, sets map[uint64][]*types.Validator) {
+	t.Helper()
+
+	setAt := func(height uint64) []*types.Validator {
+		var current []*types.Validator
+		for h := uint64(1); h <= height; h++ {
+			if set, ok := sets[h]; ok {
+				current = set
+			}
+		}
+		return current
+	}
+
+	for height := from; height <= to; height++ {
+		current := setAt(height)
+		record := &BlockRecord{Header: types.Header{
+			ChainID:            chain,
+			Height:             int64(height),
+			Time:               testGenesis.Add(time.Duration(height) * time.Second),
+			ValidatorsHash:     (&types.ValidatorSet{Validators: current}).Hash(),
+			NextValidatorsHash: (&types.ValidatorSet{Validators: setAt(height + 1)}).Hash(),
+		}}
+
+		data, err := BlockRecordToJSON(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutBlock(chain, height, data); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err = ValidatorsToJSON(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutValidators(chain, height, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateValsetHistoryPruned(t *testing.T) {
+	db := newTestStore(t)
+
+	sets := map[uint64][]*types.Validator{
+		1:  testValidators(10, 10),
+		7:  testValidators(10, 20),
+		12: testValidators(30, 20),
+	}
+	storeTestBlocks(t, db, "gopher", 5, 10, sets)
+
+	progress := (*ChainProgress)(nil).WithUnavailable(1, 5).Record([]HeightRange{{From: 5, To: 10}}, nil)
+	if err := db.PutProgress("gopher", progress); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &ChainConfig{Name: "gopher", MinHeight: 1}
+	rpc, err := NewRPCClient([]string{"http://127.0.0.1:1"}, chain.Name, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, reached, err := updateValsetHistory(context.Background(), db, rpc, chain, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reached != 10 {
+		t.Errorf("reached %d, want 10", reached)
+	}
+	if len(records) != 2 || records[0].Height != 5 || records[1].Height != 7 {
+		t.Fatalf("records %+v, want changes at 5 and 7", records)
+	}
+	for _, r := range records {
+		if len(r.Mismatches) > 0 {
+			t.Errorf("record at %d has mismatches %v", r.Height, r.Mismatches)
+		}
+	}
+
+	// the stored history is extended, not computed again
+	storeTestBlocks(t, db, "gopher", 11, 12, sets)
+
+	records, reached, err = updateValsetHistory(context.Background(), db, rpc, chain, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached != 12 || len(records) != 3 || records[2].Height != 12 {
+		t.Fatalf("reached %d with %d records, want 12 with 3", reached, len(records))
+	}
+	if records[2].OldValidatorsHash != records[1].ValidatorsHash {
+		t.Errorf("old validators hash %s, want %s", records[2].OldValidatorsHash, records[1].ValidatorsHash)
+	}
+}
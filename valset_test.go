@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidatorSetDiff(t *testing.T) {
+	set := ValidatorSet{{"A", 10}, {"B", 20}, {"C", 30}}
+
+	tests := []struct {
+		name  string
+		from  ValidatorSet
+		to    ValidatorSet
+		want  ValsetDiff
+		lines string
+	}{
+		{"equal", set, set, ValsetDiff{}, "no differences"},
+		{"from empty", nil, ValidatorSet{{"A", 10}}, ValsetDiff{Added: []ValidatorPower{{"A", 10}}}, "+ A 10"},
+		{"to empty", ValidatorSet{{"A", 10}}, nil, ValsetDiff{Removed: []ValidatorPower{{"A", 10}}}, "- A 10"},
+		{
+			name:  "added, removed and changed",
+			from:  set,
+			to:    ValidatorSet{{"B", 25}, {"C", 30}, {"D", 5}},
+			want:  ValsetDiff{Added: []ValidatorPower{{"D", 5}}, Removed: []ValidatorPower{{"A", 10}}, Changed: []PowerChange{{"B", 20, 25}}},
+			lines: "+ D 5\n- A 10\n~ B 20 -> 25",
+		},
+		{
+			name:  "interleaved addresses",
+			from:  ValidatorSet{{"A", 1}, {"C", 3}, {"E", 5}},
+			to:    ValidatorSet{{"B", 2}, {"C", 3}, {"D", 4}},
+			want:  ValsetDiff{Added: []ValidatorPower{{"B", 2}, {"D", 4}}, Removed: []ValidatorPower{{"A", 1}, {"E", 5}}},
+			lines: "+ B 2\n+ D 4\n- A 1\n- E 5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := tt.from.Diff(tt.to)
+			if !reflect.DeepEqual(diff, tt.want) {
+				t.Errorf("got %+v, want %+v", diff, tt.want)
+			}
+			if diff.String() != tt.lines {
+				t.Errorf("got %q, want %q", diff.String(), tt.lines)
+			}
+		})
+	}
+}
+
+func TestValidatorSetHash(t *testing.T) {
+	a := ValidatorSet{{"A", 10}, {"B", 20}}
+
+	if a.Hash() != (ValidatorSet{{"A", 10}, {"B", 20}}).Hash() {
+		t.Errorf("equal sets hash differently")
+	}
+	if a.Hash() == (ValidatorSet{{"A", 10}, {"B", 21}}).Hash() {
+		t.Errorf("sets with different powers hash the same")
+	}
+	if a.Hash() == (ValidatorSet{{"A", 10}}).Hash() {
+		t.Errorf("sets with different members hash the same")
+	}
+}
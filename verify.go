@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+	"github.com/tendermint/tendermint/types"
+)
+
+// Checks run by db verify.
+const (
+	checkDecode = "decode"
+	checkHeight = "height"
+	checkLink   = "link"
+	// checkValset and checkNextValset are validator sets whose hash differs
+	// from the header's ValidatorsHash or the previous header's NextValidatorsHash.
+	checkValset     = "valset_hash"
+	checkNextValset = "next_valset_hash"
+)
+
+// VerifyIssue is a stored entry that failed a check.
+type VerifyIssue struct {
+	Chain  string
+	Height uint64
+	// Kind is the key kind of the entry: block or validatorz.
+	Kind   string
+	Check  string
+	Detail string
+}
+
+func (i VerifyIssue) String() string {
+	return fmt.Sprintf("%s %s %d: %s: %s", i.Chain, i.Kind, i.Height, i.Check, i.Detail)
+}
+
+// VerifyResult sums up the verification of one chain.
+type VerifyResult struct {
+	Chain         string
+	Blocks        uint64
+	ValidatorSets uint64
+	// Unverifiable counts the cached validator sets stored without public
+	// keys, whose hash can't be recomputed.
+	Unverifiable uint64
+	Issues       []VerifyIssue
+}
+
+// QuarantinedEntry is a bad entry moved out of the way by db verify --quarantine.
+type QuarantinedEntry struct {
+	Kind   string    `json:"kind"`
+	Check  string    `json:"check"`
+	Detail string    `json:"detail"`
+	Time   time.Time `json:"time"`
+	Data   []byte    `json:"data"`
+}
+
+func QuarantineKey(chain string, kind string, height uint64) []byte {
+	return heightKey(chain, "quarantine-"+kind, height)
+}
+
+// checkBlock decodes a stored block and checks its height against the key.
+func checkBlock(chain string, height uint64, data []byte) (*BlockRecord, *VerifyIssue) {
+	record, err := BlockRecordFromJSON(data)
+	if err != nil {
+		return nil, &VerifyIssue{Chain: chain, Height: height, Kind: "block", Check: checkDecode, Detail: err.Error()}
+	}
+
+	if record.Height < 0 || uint64(record.Height) != height {
+		return record, &VerifyIssue{Chain: chain, Height: height, Kind: "block", Check: checkHeight, Detail: fmt.Sprintf("header height is %d", record.Height)}
+	}
+
+	return record, nil
+}
+
+// checkValidators compares the hash of a cached validator set with the
+// header's ValidatorsHash and the NextValidatorsHash of prev, the header
+// before it if stored. It returns false if the set has no public keys.
+func checkValidators(chain string, header, prev *types.Header, data []byte) (bool, []VerifyIssue) {
+	height := uint64(header.Height)
+
+	validators, err := ValidatorsFromJSON(data)
+	if err != nil {
+		return true, []VerifyIssue{{Chain: chain, Height: height, Kind: "validatorz", Check: checkDecode, Detail: err.Error()}}
+	}
+
+	if !hasPubKeys(validators) {
+		return false, nil
+	}
+
+	issues := []VerifyIssue{}
+	for _, mismatch := range checkValsetHash(chain, validators, header, prev) {
+		check := checkValset
+		if mismatch.Field == fieldNextValidatorsHash {
+			check = checkNextValset
+		}
+		issues = append(issues, VerifyIssue{Chain: chain, Height: height, Kind: "validatorz", Check: check, Detail: mismatch.String()})
+	}
+
+	return true, issues
+}
+
+// verifyChain runs every check on the stored blocks and validator sets of a chain.
+func verifyChain(ctx context.Context, db *Store, chain string, reporter *ProgressReporter) (*VerifyResult, error) {
+	result := &VerifyResult{Chain: chain}
+
+	iter := db.Blocks(chain, 0, math.MaxUint64)
+	defer iter.Release()
+
+	var prev *BlockRecord
+
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		_, _, height, ok := parseHeightKey(iter.Key())
+		if !ok {
+			continue
+		}
+		result.Blocks++
+		reporter.Add(1)
+
+		record, issue := checkBlock(chain, height, iter.Value())
+		if issue != nil {
+			result.Issues = append(result.Issues, *issue)
+			reporter.Error()
+			prev = nil
+			continue
+		}
+
+		before := prev
+		if prev != nil && uint64(prev.Height) == height-1 {
+			if hash := prev.Hash(); !bytes.Equal(record.LastBlockID.Hash, hash) {
+				result.Issues = append(result.Issues, VerifyIssue{
+					Chain:  chain,
+					Height: height,
+					Kind:   "block",
+					Check:  checkLink,
+					Detail: fmt.Sprintf("last block ID %X, block %d has hash %X", record.LastBlockID.Hash, height-1, hash),
+				})
+				reporter.Error()
+			}
+		}
+		prev = record
+
+		data, err := db.Validators(chain, height)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to get validators at %d", height)
+		}
+
+		result.ValidatorSets++
+		var prevHeader *types.Header
+		if before != nil {
+			prevHeader = &before.Header
+		}
+
+		verified, issues := checkValidators(chain, &record.Header, prevHeader, data)
+		if !verified {
+			result.Unverifiable++
+		}
+		for _, issue := range issues {
+			result.Issues = append(result.Issues, issue)
+			reporter.Error()
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return result, errors.Wrapf(err, "failed to iterate blocks of %s", chain)
+	}
+
+	return result, nil
+}
+
+// repairIssues re-fetches and, if still bad, quarantines the entries of the
+// issues found on chain. A broken link re-fetches both blocks, as either can
+// be the bad one, but is never quarantined. Quarantined blocks are marked as
+// missing in the chain's progress, so the next index run fetches them again.
+// It returns how many issues are left.
+func repairIssues(ctx context.Context, db *Store, chain *ChainConfig, issues []VerifyIssue, refetch, quarantine bool) (int, error) {
+	var rpc *RPCClient
+	if refetch {
+		var err error
+		rpc, err = NewRPCClient(chain.Endpoints, chain.Name, db)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to create RPC client")
+		}
+	}
+
+	quarantined := []uint64{}
+	remaining := 0
+
+	// the validator set history embeds the stored blocks and validator sets,
+	// it is computed again from the first height touched
+	var firstHeight uint64 = math.MaxUint64
+	defer func() {
+		if firstHeight == math.MaxUint64 {
+			return
+		}
+		if err := db.TruncateValsetHistory(chain.Name, firstHeight); err != nil {
+			log.Errorf("failed to truncate validator set history of %s: %s", chain.Name, err)
+		}
+	}()
+
+	for _, issue := range issues {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if issue.Check == checkLink {
+			firstHeight = minHeight(firstHeight, issue.Height-1)
+		} else {
+			firstHeight = minHeight(firstHeight, issue.Height)
+		}
+
+		if refetch {
+			heights := []uint64{issue.Height}
+			if issue.Check == checkLink {
+				heights = append(heights, issue.Height-1)
+			}
+
+			fixed := true
+			for _, height := range heights {
+				if err := refetchEntry(ctx, db, rpc, chain, issue.Kind, height); err != nil {
+					log.Warningf("Failed to re-fetch %s %d of %s: %s", issue.Kind, height, chain.Name, err)
+					fixed = false
+				}
+			}
+			if fixed {
+				log.Infof("Re-fetched %s", issue)
+				continue
+			}
+		}
+
+		if !quarantine || issue.Check == checkLink {
+			remaining++
+			continue
+		}
+
+		if err := quarantineEntry(db, issue); err != nil {
+			return 0, err
+		}
+		if issue.Kind == "block" {
+			quarantined = append(quarantined, issue.Height)
+		}
+		log.Infof("Quarantined %s", issue)
+	}
+
+	if len(quarantined) == 0 {
+		return remaining, nil
+	}
+
+	progress, err := db.Progress(chain.Name)
+	if err != nil || progress == nil {
+		return remaining, err
+	}
+
+	return remaining, db.PutProgress(chain.Name, progress.WithMissing(quarantined))
+}
+
+func minHeight(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// refetchEntry fetches an entry again and checks it before it replaces the stored one.
+func refetchEntry(ctx context.Context, db *Store, rpc *RPCClient, chain *ChainConfig, kind string, height uint64) error {
+	switch kind {
+	case "block":
+		var data []byte
+		var evidence []byte
+		var err error
+
+		if chain.HeadersOnly {
+			var record *BlockRecord
+			record, evidence, err = rpc.GetBlockRecord(ctx, height)
+			if err == nil {
+				data, err = BlockRecordToJSON(record)
+			}
+		} else {
+			var block *types.Block
+			block, evidence, err = rpc.GetBlockByHeight(ctx, height)
+			if err == nil {
+				data, err = BlockToJSON(block)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, issue := checkBlock(chain.Name, height, data); issue != nil {
+			return errors.New(issue.Detail)
+		}
+
+		if err := db.PutBlock(chain.Name, height, data); err != nil {
+			return err
+		}
+		if evidence != nil {
+			return db.PutEvidence(chain.Name, height, evidence)
+		}
+		return nil
+
+	case "validatorz":
+		validators, err := rpc.fetchValidatorsAtHeight(ctx, int64(height))
+		if err != nil {
+			return err
+		}
+
+		data, err := db.Block(chain.Name, height)
+		if err != nil {
+			return errors.Wrap(err, "failed to get block")
+		}
+		record, err := BlockRecordFromJSON(data)
+		if err != nil {
+			return err
+		}
+		if mismatches := checkValsetHash(chain.Name, validators, &record.Header, nil); len(mismatches) > 0 {
+			return errors.New(mismatches[0].String())
+		}
+
+		data, err = ValidatorsToJSON(validators)
+		if err != nil {
+			return err
+		}
+		return db.PutValidators(chain.Name, height, data)
+	}
+
+	return errors.Errorf("can't re-fetch %s entries", kind)
+}
+
+// quarantineEntry moves the entry of issue under a quarantine key.
+func quarantineEntry(db *Store, issue VerifyIssue) error {
+	key := heightKey(issue.Chain, issue.Kind, issue.Height)
+
+	data, err := db.Get(key)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %s", key)
+	}
+
+	entry, err := json.Marshal(QuarantinedEntry{
+		Kind:   issue.Kind,
+		Check:  issue.Check,
+		Detail: issue.Detail,
+		Time:   time.Now().UTC(),
+		Data:   data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode quarantined entry")
+	}
+
+	batch := new(Batch)
+	batch.Put(QuarantineKey(issue.Chain, issue.Kind, issue.Height), entry)
+	batch.Delete(key)
+
+	return db.Write(batch)
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/starclusterteam/go-starbox/log"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/rpc/coretypes"
+)
+
+// VSC packets carry validator set changes over an IBC channel between the
+// provider port of the provider and the consumer port of a consumer chain.
+const (
+	vscProviderPort = "provider"
+	vscConsumerPort = "consumer"
+)
+
+// IBC packet events the VSC index is built from.
+const (
+	eventSendPacket = "send_packet"
+	eventRecvPacket = "recv_packet"
+	eventWriteAck   = "write_acknowledgement"
+	eventAckPacket  = "acknowledge_packet"
+)
+
+// vscApplyDelay is how many blocks after the consumer receives a VSC packet
+// its changes show up in the ValidatorsHash: updates returned by EndBlock at
+// height h are in effect from h+2. The same holds for the provider's own set
+// and the updates it sends at h.
+const vscApplyDelay = 2
+
+// VSCPacket is a validator set change packet as seen by one chain. On the
+// provider Height is the block that sent it and AckHeight the block that got
+// its acknowledgement back; on a consumer Height is the block that received
+// it and AckHeight the block that wrote the acknowledgement.
+type VSCPacket struct {
+	ID         uint64 `json:"valset_update_id"`
+	Height     uint64 `json:"height,omitempty"`
+	SrcChannel string `json:"src_channel"`
+	DstChannel string `json:"dst_channel"`
+	Sequence   uint64 `json:"sequence"`
+	// Updates is the number of validator updates in the packet.
+	Updates   int    `json:"updates"`
+	AckHeight uint64 `json:"ack_height,omitempty"`
+	AckError  string `json:"ack_error,omitempty"`
+}
+
+func (p VSCPacket) String() string {
+	return fmt.Sprintf("VSC %d (%s/%d, %d updates)", p.ID, p.SrcChannel, p.Sequence, p.Updates)
+}
+
+// merge fills p with the fields other knows about.
+func (p *VSCPacket) merge(other VSCPacket) {
+	if other.Height != 0 {
+		p.Height = other.Height
+	}
+	if other.Updates != 0 {
+		p.Updates = other.Updates
+	}
+	if other.AckHeight != 0 {
+		p.AckHeight = other.AckHeight
+	}
+	if other.AckError != "" {
+		p.AckError = other.AckError
+	}
+}
+
+// VSCKey is the key of the packets with a valset update ID. The provider
+// sends the same ID to every consumer, so the value is a list.
+func VSCKey(chain string, id uint64) []byte {
+	return heightKey(chain, "vsc", id)
+}
+
+// VSCPackets returns the stored packets of a chain with the given valset update ID.
+func (s *Store) VSCPackets(chain string, id uint64) ([]VSCPacket, error) {
+	data, err := s.Get(VSCKey(chain, id))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get VSC %d", id)
+	}
+
+	packets := []VSCPacket{}
+	if err := json.Unmarshal(data, &packets); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode VSC %d", id)
+	}
+
+	return packets, nil
+}
+
+// PutVSCPacket stores p, merged with the stored packet of the same channel
+// and sequence if there is one.
+func (s *Store) PutVSCPacket(chain string, p VSCPacket) error {
+	packets, err := s.VSCPackets(chain, p.ID)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range packets {
+		if packets[i].SrcChannel == p.SrcChannel && packets[i].Sequence == p.Sequence {
+			packets[i].merge(p)
+			found = true
+		}
+	}
+	if !found {
+		packets = append(packets, p)
+	}
+
+	data, err := json.Marshal(packets)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode VSC packets")
+	}
+
+	return s.Put(VSCKey(chain, p.ID), data)
+}
+
+// AllVSCPackets returns the stored packets of a chain ordered by valset update ID.
+func (s *Store) AllVSCPackets(chain string) ([]VSCPacket, error) {
+	iter := s.NewIterator(PrefixRange([]byte(chain + ":vsc:")))
+	defer iter.Release()
+
+	all := []VSCPacket{}
+	for iter.Next() {
+		packets := []VSCPacket{}
+		if err := json.Unmarshal(iter.Value(), &packets); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", iter.Key())
+		}
+		all = append(all, packets...)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate VSC packets")
+	}
+
+	return all, nil
+}
+
+// eventAttributes returns the attributes of an event. Tendermint 0.34 nodes
+// send keys and values base64 encoded; none of the packet attribute names
+// are valid base64, so decoded keys are told apart by their prefix.
+func eventAttributes(event abci.Event) map[string]string {
+	attributes := map[string]string{}
+
+	for _, a := range event.Attributes {
+		key, value := a.Key, a.Value
+
+		if k, err := base64.StdEncoding.DecodeString(key); err == nil && strings.HasPrefix(string(k), "packet_") {
+			v, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			key, value = string(k), string(v)
+		}
+
+		attributes[key] = value
+	}
+
+	return attributes
+}
+
+// decodeVSCPacketData returns the valset update ID and the number of
+// validator updates of a packet's ValidatorSetChangePacketData.
+func decodeVSCPacketData(attributes map[string]string) (uint64, int, error) {
+	data := []byte(attributes["packet_data"])
+	if len(data) == 0 {
+		var err error
+		data, err = hex.DecodeString(attributes["packet_data_hex"])
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "failed to decode packet_data_hex")
+		}
+	}
+
+	var packet struct {
+		ValidatorUpdates []json.RawMessage `json:"validator_updates"`
+		ValsetUpdateID   json.Number       `json:"valset_update_id"`
+	}
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return 0, 0, errors.Wrap(err, "failed to decode VSC packet data")
+	}
+
+	id, err := strconv.ParseUint(packet.ValsetUpdateID.String(), 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid valset update ID %q", packet.ValsetUpdateID)
+	}
+
+	return id, len(packet.ValidatorUpdates), nil
+}
+
+// ackError returns the error of a failed acknowledgement, or "" if it succeeded.
+func ackError(ack string) string {
+	var result struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(ack), &result); err != nil {
+		return ""
+	}
+	return result.Error
+}
+
+// vscIndexer stores the VSC packet events of one chain: sends and
+// acknowledgements on the provider, receipts and written acknowledgements on
+// a consumer. It is safe for concurrent use.
+type vscIndexer struct {
+	db       *Store
+	chain    string
+	provider bool
+
+	mu sync.Mutex
+	// sent maps the channel and sequence of provider packets to their valset
+	// update ID, as acknowledgements don't carry the packet data.
+	sent map[string]uint64
+	// pending holds acknowledgements seen before their packet was sent.
+	pending []VSCPacket
+
+	packets int
+	acks    int
+}
+
+func newVSCIndexer(db *Store, chain string) (*vscIndexer, error) {
+	x := &vscIndexer{db: db, chain: chain, provider: chain == providerName, sent: map[string]uint64{}}
+
+	if !x.provider {
+		return x, nil
+	}
+
+	packets, err := db.AllVSCPackets(chain)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packets {
+		x.sent[packetKey(p.SrcChannel, p.Sequence)] = p.ID
+	}
+
+	return x, nil
+}
+
+func packetKey(channel string, sequence uint64) string {
+	return fmt.Sprintf("%s/%d", channel, sequence)
+}
+
+// handle stores the VSC packet events among the events of a block.
+func (x *vscIndexer) handle(height uint64, events []abci.Event) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, event := range events {
+		switch event.Type {
+		case eventSendPacket, eventRecvPacket, eventWriteAck, eventAckPacket:
+		default:
+			continue
+		}
+
+		attributes := eventAttributes(event)
+		if x.provider && attributes["packet_src_port"] != vscProviderPort {
+			continue
+		}
+		if !x.provider && attributes["packet_dst_port"] != vscConsumerPort {
+			continue
+		}
+
+		sequence, err := strconv.ParseUint(attributes["packet_sequence"], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "%s at %d: invalid packet sequence", event.Type, height)
+		}
+
+		packet := VSCPacket{
+			SrcChannel: attributes["packet_src_channel"],
+			DstChannel: attributes["packet_dst_channel"],
+			Sequence:   sequence,
+		}
+
+		switch {
+		case x.provider && event.Type == eventSendPacket,
+			!x.provider && event.Type == eventRecvPacket:
+			packet.ID, packet.Updates, err = decodeVSCPacketData(attributes)
+			packet.Height = height
+			x.packets++
+
+		case !x.provider && event.Type == eventWriteAck:
+			packet.ID, packet.Updates, err = decodeVSCPacketData(attributes)
+			packet.AckHeight = height
+			packet.AckError = ackError(attributes["packet_ack"])
+			x.acks++
+
+		case x.provider && event.Type == eventAckPacket:
+			packet.AckHeight = height
+			x.acks++
+
+			id, ok := x.sent[packetKey(packet.SrcChannel, packet.Sequence)]
+			if !ok {
+				x.pending = append(x.pending, packet)
+				continue
+			}
+			packet.ID = id
+
+		default:
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s at %d", event.Type, height)
+		}
+
+		if x.provider && event.Type == eventSendPacket {
+			x.sent[packetKey(packet.SrcChannel, packet.Sequence)] = packet.ID
+		}
+
+		if err := x.db.PutVSCPacket(x.chain, packet); err != nil {
+			return errors.Wrapf(err, "failed to save VSC %d", packet.ID)
+		}
+	}
+
+	return nil
+}
+
+// flush stores the pending acknowledgements whose packet has been seen since
+// and returns how many are left unmatched.
+func (x *vscIndexer) flush() (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	unmatched := 0
+	for _, packet := range x.pending {
+		id, ok := x.sent[packetKey(packet.SrcChannel, packet.Sequence)]
+		if !ok {
+			log.Debugf("No VSC packet sent for acknowledgement of %s at %d", packetKey(packet.SrcChannel, packet.Sequence), packet.AckHeight)
+			unmatched++
+			continue
+		}
+
+		packet.ID = id
+		if err := x.db.PutVSCPacket(x.chain, packet); err != nil {
+			return 0, errors.Wrapf(err, "failed to save VSC %d", packet.ID)
+		}
+	}
+	x.pending = nil
+
+	return unmatched, nil
+}
+
+// blockEvents returns the block events and the events of the successful
+// transactions of a block.
+func blockEvents(results *coretypes.ResultBlockResults) []abci.Event {
+	events := append([]abci.Event{}, results.BeginBlockEvents...)
+	for _, tx := range results.TxsResults {
+		if tx != nil && tx.Code == 0 {
+			events = append(events, tx.Events...)
+		}
+	}
+	return append(events, results.EndBlockEvents...)
+}
+
+// indexVSCEvents indexes the VSC packet events of a chain between from and
+// to. By default it finds them through the node's event index: block_search
+// for the provider's sends, which happen in EndBlock, and tx_search for
+// everything relayed. With scan it reads the block results of every height
+// instead, for nodes that don't index events.
+func indexVSCEvents(ctx context.Context, db *Store, rpc *RPCClient, from, to uint64, workers int, scan bool) error {
+	x, err := newVSCIndexer(db, rpc.Name())
+	if err != nil {
+		return err
+	}
+
+	if scan {
+		err = scanVSCEvents(ctx, rpc, x, from, to, workers)
+	} else {
+		err = searchVSCEvents(ctx, rpc, x, from, to)
+	}
+	if err != nil {
+		return err
+	}
+
+	unmatched, err := x.flush()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Indexed %d VSC packets and %d acknowledgements of %s", x.packets, x.acks, rpc.Name())
+	if unmatched > 0 {
+		return partialData(errors.Errorf("%d acknowledgements of %s have no indexed VSC packet, index the heights that sent them", unmatched, rpc.Name()))
+	}
+
+	return nil
+}
+
+func searchVSCEvents(ctx context.Context, rpc *RPCClient, x *vscIndexer, from, to uint64) error {
+	txQuery := fmt.Sprintf("%s.packet_dst_port='%s' AND tx.height>=%d AND tx.height<=%d", eventRecvPacket, vscConsumerPort, from, to)
+
+	if x.provider {
+		heights, err := rpc.SearchBlocks(ctx, fmt.Sprintf("%s.packet_src_port='%s' AND block.height>=%d AND block.height<=%d", eventSendPacket, vscProviderPort, from, to))
+		if err != nil {
+			return err
+		}
+		log.Infof("Found %d blocks of %s sending VSC packets", len(heights), rpc.Name())
+
+		reporter := NewProgressReporter("vsc "+rpc.Name(), "blocks", uint64(len(heights)))
+		defer reporter.Stop()
+
+		for _, height := range heights {
+			results, err := rpc.GetBlockResults(ctx, height)
+			if err != nil {
+				return err
+			}
+			if err := x.handle(height, blockEvents(results)); err != nil {
+				return err
+			}
+			reporter.Add(1)
+		}
+
+		txQuery = fmt.Sprintf("%s.packet_src_port='%s' AND tx.height>=%d AND tx.height<=%d", eventAckPacket, vscProviderPort, from, to)
+	}
+
+	txs, err := rpc.SearchTxs(ctx, txQuery)
+	if err != nil {
+		return err
+	}
+	log.Infof("Found %d transactions of %s relaying VSC packets", len(txs), rpc.Name())
+
+	for _, tx := range txs {
+		if tx.TxResult.Code != 0 {
+			continue
+		}
+		if err := x.handle(uint64(tx.Height), tx.TxResult.Events); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanVSCEvents(ctx context.Context, rpc *RPCClient, x *vscIndexer, from, to uint64, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	reporter := NewProgressReporter("vsc "+rpc.Name(), "blocks", to-from+1)
+	defer reporter.Stop()
+	rpc.SetReporter(reporter)
+	defer rpc.SetReporter(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var scanErr error
+	heights := make(chan uint64, workers)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for height := range heights {
+				results, err := rpc.GetBlockResults(ctx, height)
+				if err == nil {
+					err = x.handle(height, blockEvents(results))
+				}
+				if err != nil {
+					once.Do(func() {
+						scanErr = err
+						cancel()
+					})
+					continue
+				}
+				reporter.Add(1)
+			}
+		}()
+	}
+
+feed:
+	for height := from; height <= to; height++ {
+		select {
+		case heights <- height:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(heights)
+
+	wg.Wait()
+
+	if scanErr != nil {
+		return scanErr
+	}
+	return ctx.Err()
+}
+
+// VSCAttribution ties a consumer validator set change to the VSC packets
+// received vscApplyDelay blocks before it, and to the provider block that
+// sent the last of them.
+type VSCAttribution struct {
+	Consumer       ValsetUpdate
+	Packets        []VSCPacket
+	ProviderHeight uint64
+	// Provider is the provider set in effect vscApplyDelay blocks after
+	// ProviderHeight, which the consumer set should mirror; nil if unknown.
+	Provider *ValsetUpdate
+}
+
+// ID returns the valset update ID the consumer set corresponds to, the
+// highest among the packets.
+func (a VSCAttribution) ID() uint64 {
+	var id uint64
+	for _, p := range a.Packets {
+		if p.ID > id {
+			id = p.ID
+		}
+	}
+	return id
+}
+
+// Matches reports whether the consumer set equals the provider set it was attributed to.
+func (a VSCAttribution) Matches() bool {
+	return a.Provider != nil && a.Provider.SetHash == a.Consumer.SetHash
+}
+
+// VSCReport is the outcome of correlating a consumer's validator set changes
+// with the VSC packets of its channel.
+type VSCReport struct {
+	Attributions []VSCAttribution
+	// Unattributed are consumer set changes without a VSC packet received
+	// vscApplyDelay blocks before.
+	Unattributed []ValsetUpdate
+	// Dropped are packets the provider sent that the consumer never
+	// received, although it received earlier and later ones.
+	Dropped []VSCPacket
+	// Reordered are packets the consumer received after a packet with a
+	// higher valset update ID.
+	Reordered []VSCPacket
+	// Failed are packets whose acknowledgement is an error.
+	Failed []VSCPacket
+}
+
+// correlateVSC attributes the consumer set changes to the packets that
+// produced them. Only consumer changes within the heights covered by the
+// consumer's indexed packets are attributed.
+func correlateVSC(providerPackets, consumerPackets []VSCPacket, provider, consumer []ValsetUpdate) *VSCReport {
+	report := &VSCReport{}
+
+	received := []VSCPacket{}
+	channels := map[string]bool{}
+	for _, p := range consumerPackets {
+		if p.Height == 0 {
+			continue
+		}
+		received = append(received, p)
+		channels[p.SrcChannel] = true
+		if p.AckError != "" {
+			report.Failed = append(report.Failed, p)
+		}
+	}
+	if len(received) == 0 {
+		return report
+	}
+
+	sort.Slice(received, func(i, j int) bool {
+		if received[i].Height != received[j].Height {
+			return received[i].Height < received[j].Height
+		}
+		return received[i].Sequence < received[j].Sequence
+	})
+
+	byHeight := map[uint64][]VSCPacket{}
+	receivedIDs := map[uint64]bool{}
+	var minID, maxID uint64 = math.MaxUint64, 0
+	for _, p := range received {
+		byHeight[p.Height] = append(byHeight[p.Height], p)
+		receivedIDs[p.ID] = true
+		if p.ID < maxID {
+			report.Reordered = append(report.Reordered, p)
+		}
+		if p.ID > maxID {
+			maxID = p.ID
+		}
+		if p.ID < minID {
+			minID = p.ID
+		}
+	}
+
+	sent := map[uint64]VSCPacket{}
+	for _, p := range providerPackets {
+		if !channels[p.SrcChannel] {
+			continue
+		}
+		sent[p.ID] = p
+		// earlier packets may predate the indexed consumer heights
+		if !receivedIDs[p.ID] && p.ID > minID && p.ID < maxID {
+			report.Dropped = append(report.Dropped, p)
+		}
+	}
+
+	first := received[0].Height + vscApplyDelay
+	last := received[len(received)-1].Height + vscApplyDelay
+
+	for _, vs := range consumer {
+		height := uint64(vs.Height)
+		if vs.OldSetHash == "" || height < first || height > last {
+			continue
+		}
+
+		packets := byHeight[height-vscApplyDelay]
+		if len(packets) == 0 {
+			report.Unattributed = append(report.Unattributed, vs)
+			continue
+		}
+
+		attribution := VSCAttribution{Consumer: vs, Packets: packets}
+		if p, ok := sent[attribution.ID()]; ok && p.Height != 0 {
+			attribution.ProviderHeight = p.Height
+			attribution.Provider = activeAtHeight(provider, p.Height+vscApplyDelay)
+		}
+
+		report.Attributions = append(report.Attributions, attribution)
+	}
+
+	return report
+}
+
+// activeAtHeight returns the validator set update in effect at height, or
+// nil if the first update is later.
+func activeAtHeight(validatorSet []ValsetUpdate, height uint64) *ValsetUpdate {
+	i := sort.Search(len(validatorSet), func(i int) bool {
+		return uint64(validatorSet[i].Height) > height
+	})
+	if i == 0 {
+		return nil
+	}
+	return &validatorSet[i-1]
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testUpdate(height int64, set, old string) ValsetUpdate {
+	return ValsetUpdate{
+		Height:     height,
+		Timestamp:  testGenesis.Add(time.Duration(height) * time.Second),
+		SetHash:    set,
+		OldSetHash: old,
+	}
+}
+
+func testPacket(id, height uint64) VSCPacket {
+	return VSCPacket{ID: id, Height: height, SrcChannel: "channel-0", Sequence: id}
+}
+
+func packetIDs(packets []VSCPacket) []uint64 {
+	ids := []uint64{}
+	for _, p := range packets {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func updateHeights(updates []ValsetUpdate) []int64 {
+	heights := []int64{}
+	for _, u := range updates {
+		heights = append(heights, u.Height)
+	}
+	return heights
+}
+
+func TestCorrelateVSC(t *testing.T) {
+	provider := []ValsetUpdate{
+		testUpdate(12, "A", ""),
+		testUpdate(22, "B", "A"),
+		testUpdate(32, "C", "B"),
+		testUpdate(42, "D", "C"),
+	}
+	providerPackets := []VSCPacket{testPacket(1, 10), testPacket(2, 20), testPacket(3, 30), testPacket(4, 40)}
+
+	// attribution is the consumer height, provider height and whether the sets match
+	type attribution struct {
+		Height         int64
+		ProviderHeight uint64
+		Matches        bool
+	}
+
+	tests := []struct {
+		name            string
+		providerPackets []VSCPacket
+		received        []VSCPacket
+		consumer        []ValsetUpdate
+
+		attributions []attribution
+		unattributed []int64
+		dropped      []uint64
+		reordered    []uint64
+		failed       []uint64
+	}{
+		{
+			name:            "in order",
+			providerPackets: providerPackets,
+			received:        []VSCPacket{testPacket(1, 100), testPacket(2, 110), testPacket(3, 120), testPacket(4, 130)},
+			consumer: []ValsetUpdate{
+				testUpdate(90, "0", ""),
+				testUpdate(102, "A", "0"),
+				testUpdate(112, "B", "A"),
+				testUpdate(122, "C", "B"),
+				testUpdate(132, "D", "C"),
+			},
+			attributions: []attribution{{102, 10, true}, {112, 20, true}, {122, 30, true}, {132, 40, true}},
+		},
+		{
+			name:            "mismatch and unattributed change",
+			providerPackets: providerPackets,
+			received:        []VSCPacket{testPacket(1, 100), testPacket(2, 110)},
+			consumer: []ValsetUpdate{
+				testUpdate(102, "A", "0"),
+				testUpdate(105, "X", "A"),
+				testUpdate(112, "Y", "X"),
+			},
+			attributions: []attribution{{102, 10, true}, {112, 20, false}},
+			unattributed: []int64{105},
+		},
+		{
+			name:            "dropped between received packets",
+			providerPackets: providerPackets,
+			received:        []VSCPacket{testPacket(1, 100), testPacket(3, 120)},
+			consumer:        []ValsetUpdate{testUpdate(102, "A", "0"), testUpdate(122, "C", "A")},
+			attributions:    []attribution{{102, 10, true}, {122, 30, true}},
+			dropped:         []uint64{2},
+		},
+		{
+			name:            "packets sent before the indexed consumer heights",
+			providerPackets: providerPackets,
+			received:        []VSCPacket{testPacket(3, 120), testPacket(4, 130)},
+			consumer:        []ValsetUpdate{testUpdate(122, "C", "B"), testUpdate(132, "D", "C")},
+			attributions:    []attribution{{122, 30, true}, {132, 40, true}},
+		},
+		{
+			name:            "packets sent after the last received one",
+			providerPackets: providerPackets,
+			received:        []VSCPacket{testPacket(1, 100)},
+			consumer:        []ValsetUpdate{testUpdate(102, "A", "0")},
+			attributions:    []attribution{{102, 10, true}},
+		},
+		{
+			name:            "reordered",
+			providerPackets: providerPackets,
+			received:        []VSCPacket{testPacket(2, 100), testPacket(1, 110)},
+			reordered:       []uint64{1},
+		},
+		{
+			name:            "ack error",
+			providerPackets: providerPackets,
+			received: []VSCPacket{
+				testPacket(1, 100),
+				{ID: 2, Height: 110, SrcChannel: "channel-0", Sequence: 2, AckError: "invalid packet"},
+			},
+			failed: []uint64{2},
+		},
+		{
+			name: "other channels are ignored",
+			providerPackets: append([]VSCPacket{{ID: 2, Height: 20, SrcChannel: "channel-1", Sequence: 2}},
+				testPacket(1, 10), testPacket(3, 30)),
+			received: []VSCPacket{testPacket(1, 100), testPacket(3, 120)},
+			dropped:  []uint64{},
+		},
+		{
+			name:            "no received packets",
+			providerPackets: providerPackets,
+			consumer:        []ValsetUpdate{testUpdate(102, "A", "0")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := correlateVSC(tt.providerPackets, tt.received, provider, tt.consumer)
+
+			attributions := []attribution{}
+			for _, a := range report.Attributions {
+				attributions = append(attributions, attribution{a.Consumer.Height, a.ProviderHeight, a.Matches()})
+			}
+			if tt.attributions == nil {
+				tt.attributions = []attribution{}
+			}
+			if !reflect.DeepEqual(attributions, tt.attributions) {
+				t.Errorf("attributions %v, want %v", attributions, tt.attributions)
+			}
+
+			checkIDs := func(what string, got []VSCPacket, want []uint64) {
+				if want == nil {
+					want = []uint64{}
+				}
+				if ids := packetIDs(got); !reflect.DeepEqual(ids, want) {
+					t.Errorf("%s %v, want %v", what, ids, want)
+				}
+			}
+			checkIDs("dropped", report.Dropped, tt.dropped)
+			checkIDs("reordered", report.Reordered, tt.reordered)
+			checkIDs("failed", report.Failed, tt.failed)
+
+			if tt.unattributed == nil {
+				tt.unattributed = []int64{}
+			}
+			if heights := updateHeights(report.Unattributed); !reflect.DeepEqual(heights, tt.unattributed) {
+				t.Errorf("unattributed %v, want %v", heights, tt.unattributed)
+			}
+		})
+	}
+}